@@ -0,0 +1,320 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gitlab.com/opennota/findimagedupes/dupes"
+)
+
+// plan is the file kept and the files removed from a group of duplicates.
+type plan struct {
+	keep   dupes.File
+	remove []dupes.File
+}
+
+func makePlans(groups []dupes.Group, keep dupes.KeepPolicy) []plan {
+	plans := make([]plan, 0, len(groups))
+	for _, g := range groups {
+		// The reference files are never removed; one of them is kept
+		// if there are any.
+		candidates := g.Files
+		var refs []dupes.File
+		for _, f := range g.Files {
+			if f.Reference {
+				refs = append(refs, f)
+			}
+		}
+		if len(refs) > 0 {
+			candidates = refs
+		}
+
+		p := plan{keep: candidates[keep(candidates)]}
+		for _, f := range g.Files {
+			if f.Path != p.keep.Path && !f.Reference {
+				p.remove = append(p.remove, f)
+			}
+		}
+		plans = append(plans, p)
+	}
+	return plans
+}
+
+// preview prints the plans and returns the number of files to be removed
+// and their total size.
+func preview(w io.Writer, verb string, plans []plan) (n int, size int64) {
+	for _, p := range plans {
+		fmt.Fprintf(w, "keep %s\n", p.keep.Path)
+		for _, f := range p.remove {
+			fmt.Fprintf(w, "  %s %s (%d bytes)\n", verb, f.Path, f.Size)
+			n++
+			size += f.Size
+		}
+	}
+	return n, size
+}
+
+// confirm asks the user a yes/no question on the terminal.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// apply runs do for every file to be removed, after showing what is going
+// to be done and asking for confirmation.
+func apply(plans []plan, verb, done string, dryRun, yes bool, do func(keep, f dupes.File) error) {
+	n, size := preview(os.Stdout, verb, plans)
+	if dryRun {
+		fmt.Printf("Dry run: %d files would be %s, %d bytes reclaimed.\n", n, done, size) //nolint:forbidigo
+		return
+	}
+	if n == 0 {
+		return
+	}
+	if !yes && !confirm(fmt.Sprintf("%s%s %d files?", strings.ToUpper(verb[:1]), verb[1:], n)) {
+		return
+	}
+
+	n, size = 0, 0
+	for _, p := range plans {
+		for _, f := range p.remove {
+			if err := do(p.keep, f); err != nil {
+				log.Errorf("ERROR: %v", err)
+				continue
+			}
+			n++
+			size += f.Size
+		}
+	}
+	fmt.Printf("%d files %s, %d bytes reclaimed.\n", n, done, size) //nolint:forbidigo
+}
+
+// deleteDupes removes all but one file of every group.
+func deleteDupes(plans []plan, dryRun, yes bool) {
+	apply(plans, "delete", "deleted", dryRun, yes, func(_, f dupes.File) error {
+		return os.Remove(f.Path)
+	})
+}
+
+// linkDupes replaces all but one file of every group with links to the kept
+// file and records the replacements in the journal.
+func linkDupes(plans []plan, kind string, j *journal, dryRun, yes bool) {
+	op := kind + "link"
+	if kind == "reflink" {
+		op = kind
+	}
+	apply(plans, op, op+"ed", dryRun, yes, func(keep, f dupes.File) error {
+		target, err := filepath.Abs(keep.Path)
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Abs(f.Path)
+		if err != nil {
+			return err
+		}
+
+		// The file is only replaced once the replacement is recorded.
+		return replaceWithLink(kind, target, path, func() error {
+			return j.record(op, path, target)
+		})
+	})
+}
+
+// replaceWithLink atomically replaces path with a link of the given kind
+// to target. The replacement is given up if record, called just before it,
+// fails.
+func replaceWithLink(kind, target, path string, record func() error) error {
+	fi1, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	fi2, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(fi1, fi2) {
+		return fmt.Errorf("%s and %s are the same file", path, target)
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d.tmp", filepath.Base(path), os.Getpid()))
+
+	switch kind {
+	case "hard":
+		err = os.Link(target, tmp)
+	case "sym":
+		err = os.Symlink(target, tmp)
+	case "reflink":
+		err = reflink(target, tmp)
+	default:
+		err = fmt.Errorf("unknown link kind: %s", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := record(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// moveDupes moves all but one file of every group to dir, keeping their paths
+// relative to the roots they were found under, and records the moves in the
+// journal.
+func moveDupes(plans []plan, dir string, j *journal, dryRun, yes bool) {
+	apply(plans, "move", "moved", dryRun, yes, func(_, f dupes.File) error {
+		path, err := filepath.Abs(f.Path)
+		if err != nil {
+			return err
+		}
+		dst, err := quarantinePath(dir, f.Root, path)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("%s already exists", dst)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := moveFile(path, dst); err != nil {
+			return err
+		}
+
+		// A move which is not in the journal could not be undone.
+		if err := j.record("move", path, dst); err != nil {
+			if rerr := moveFile(dst, path); rerr != nil {
+				return fmt.Errorf("%v; %s is left at %s: %v", err, path, dst, rerr)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// quarantinePath returns the path in dir to move path, which was found under
+// root, to.
+func quarantinePath(dir, root, path string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	rel := ""
+	if root != "" {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return "", err
+		}
+		rel, err = filepath.Rel(root, path)
+		if err != nil {
+			return "", err
+		}
+		if rel == "." {
+			rel = filepath.Base(path)
+		}
+	}
+	if rel == "" || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(path, filepath.VolumeName(path))
+	}
+
+	return filepath.Join(dir, rel), nil
+}
+
+// moveFile renames src to dst, copying it if they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// exactOnly drops the plans for groups whose files have different
+// fingerprints.
+func exactOnly(plans []plan) []plan {
+	var exact []plan
+	for _, p := range plans {
+		same := true
+		for _, f := range p.remove {
+			if f.FP != p.keep.FP {
+				same = false
+				break
+			}
+		}
+		if !same {
+			log.Warnf("WARNING: skipping %s: the fingerprints are not identical", p.keep.Path)
+			continue
+		}
+		exact = append(exact, p)
+	}
+	return exact
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestQuarantinePath(t *testing.T) {
+	for _, tc := range []struct {
+		root, path, want string
+	}{
+		{"/photos", "/photos/x/a.jpg", "/dupes/x/a.jpg"},
+		{"/photos", "/photos/..x/a.jpg", "/dupes/..x/a.jpg"},
+		{"/photos/a.jpg", "/photos/a.jpg", "/dupes/a.jpg"},
+		{"/photos", "/other/a.jpg", "/dupes/other/a.jpg"},
+		{"", "/other/a.jpg", "/dupes/other/a.jpg"},
+	} {
+		got, err := quarantinePath("/dupes", tc.root, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s under %q: got %s, want %s", tc.path, tc.root, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/opennota/findimagedupes/dupes"
+)
+
+// rewriteFlags are the OLD=NEW path prefix replacements of --rewrite.
+type rewriteFlags [][2]string
+
+func (f *rewriteFlags) String() string {
+	s := make([]string, 0, len(*f))
+	for _, r := range *f {
+		s = append(s, r[0]+"="+r[1])
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *rewriteFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected OLD=NEW: %s", value)
+	}
+	*f = append(*f, [2]string{value[:i], value[i+1:]})
+	return nil
+}
+
+// rewrite returns path with its prefix replaced by the first matching
+// replacement.
+func (f rewriteFlags) rewrite(path string) string {
+	for _, r := range f {
+		old := strings.TrimSuffix(r[0], "/")
+		if path == old || strings.HasPrefix(path, old+"/") {
+			return strings.TrimSuffix(r[1], "/") + path[len(old):]
+		}
+	}
+	return path
+}
+
+func dbUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: findimagedupes db COMMAND DB [ARGUMENTS]
+
+    Inspect and maintain the fingerprint database DB.
+
+    Commands:
+       stats                          Show the number of entries, the size of the database and
+                                          the oldest and newest entries
+       list [PATH]                    List the entries, or those for PATH and the files under it
+       show PATH                      Show the entries for the file PATH
+       forget PATH...                 Remove the entries for every PATH and the files under it
+       vacuum                         Reclaim the unused space
+       check                          Verify the integrity of the database and list the entries
+                                          whose files are missing or modified
+       export [PATH]                  Write the entries, or those for PATH and the files under it,
+                                          to the standard output as newline-delimited JSON
+       import [options] [FILE]        Read the entries written by export from FILE or the
+                                          standard input
+       merge IN...                    Merge the databases IN into DB, which is created if it does
+                                          not exist, keeping the entries of the most recently
+                                          modified files; all of them must contain the
+                                          fingerprints of the same hash algorithms; the inputs
+                                          are only read, so migrate them first if needed
+       migrate                        Upgrade the database to the current schema version
+
+    Import options:
+           --rewrite=OLD=NEW          Replace the path prefix OLD with NEW; may be repeated
+           --on-conflict=POLICY       What to do with the entries of the files already in the
+                                          database: keep-newer (default), overwrite or skip
+
+`)
+}
+
+// dbMain implements the db command, which maintains fingerprint databases.
+func dbMain(args []string) {
+	if len(args) < 1 {
+		dbUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "stats":
+		dbStats(args[1:])
+	case "list":
+		dbList(args[1:])
+	case "show":
+		dbShow(args[1:])
+	case "forget":
+		dbForget(args[1:])
+	case "vacuum":
+		dbVacuum(args[1:])
+	case "check":
+		dbCheck(args[1:])
+	case "export":
+		dbExport(args[1:])
+	case "import":
+		dbImport(args[1:])
+	case "merge":
+		dbMerge(args[1:])
+	case "migrate":
+		dbMigrate(args[1:])
+	case "-h", "-help", "--help":
+		dbUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown db command: %s\n\n", args[0])
+		dbUsage()
+		os.Exit(1)
+	}
+}
+
+func dbExport(args []string) {
+	db, args := openDB(args, "export DB [PATH]", 0, 1)
+	defer db.Close()
+
+	var path string
+	if len(args) > 0 {
+		path, _ = filepath.Abs(args[0])
+	}
+
+	if _, err := db.Export(context.Background(), os.Stdout, path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dbImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var rewrites rewriteFlags
+	var conflict string
+	fs.Var(&rewrites, "rewrite", "Replace the path prefix OLD with NEW")
+	fs.StringVar(&conflict, "on-conflict", "keep-newer", "What to do with the entries already in the database: "+strings.Join(dupes.Conflicts, ", "))
+	_ = fs.Parse(args)
+
+	policy, err := dupes.ParseConflict(conflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, args := openDB(fs.Args(), "import [--rewrite=OLD=NEW]... [--on-conflict=POLICY] DB [FILE]", 0, 1)
+	defer db.Close()
+
+	in := os.Stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	opts := dupes.ImportOptions{Conflict: policy}
+	if len(rewrites) > 0 {
+		opts.Rewrite = rewrites.rewrite
+	}
+	stored, skipped, err := db.Import(context.Background(), in, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d entries imported, %d skipped.\n", stored, skipped) //nolint:forbidigo
+}
+
+// dbAlgos returns the hash algorithms of the fingerprints in db.
+func dbAlgos(db *dupes.DB) string {
+	st, err := db.Stats(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	algos := make([]string, 0, len(st.Algos))
+	for algo := range st.Algos {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	return strings.Join(algos, ",")
+}
+
+func dbMerge(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: findimagedupes db merge OUT IN...\n")
+		os.Exit(1)
+	}
+	outPath, inputs := args[0], args[1:]
+
+	out, err := dupes.OpenDatabase(outPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	outInfo, err := os.Stat(outPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check all the inputs first; they are not modified.
+	algos, from := dbAlgos(out), outPath
+	for _, path := range inputs {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if os.SameFile(fi, outInfo) {
+			log.Fatalf("%s is both an input and the output", path)
+		}
+
+		list, err := dupes.MergeableAlgos(path)
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		a := strings.Join(list, ",")
+
+		switch {
+		case a == "":
+		case algos == "":
+			algos, from = a, path
+		case a != algos:
+			log.Fatalf("%s contains fingerprints of %s, but %s of %s", path, a, from, algos)
+		}
+	}
+
+	for _, path := range inputs {
+		n, err := out.Merge(context.Background(), path)
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		fmt.Printf("%s: %d entries merged.\n", path, n) //nolint:forbidigo
+	}
+}
+
+func dbMigrate(args []string) {
+	// Not openDB, which would upgrade the database too.
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: findimagedupes db migrate DB\n")
+		os.Exit(1)
+	}
+
+	if _, err := os.Stat(args[0]); err != nil {
+		log.Fatal(err)
+	}
+
+	from, to, err := dupes.Migrate(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if from == to {
+		fmt.Printf("Schema version %d is up to date.\n", to) //nolint:forbidigo
+		return
+	}
+	fmt.Printf("Upgraded from schema version %d to %d.\n", from, to) //nolint:forbidigo
+}
+
+// openDB opens the existing fingerprint database at path, or exits if the
+// command line is invalid.
+func openDB(args []string, usage string, minArgs, maxArgs int) (*dupes.DB, []string) {
+	if len(args) < minArgs+1 || maxArgs >= 0 && len(args) > maxArgs+1 {
+		fmt.Fprintf(os.Stderr, "Usage: findimagedupes db %s\n", usage)
+		os.Exit(1)
+	}
+
+	if dupes.BackendOf(args[0]) != "sqlite" {
+		log.Fatalf("%s: only SQLite databases are supported", args[0])
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		log.Fatal(err)
+	}
+	db, err := dupes.OpenDatabase(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db, args[1:]
+}
+
+func formatTime(nsec int64) string {
+	return time.Unix(0, nsec).Format("2006-01-02 15:04:05")
+}
+
+func dbStats(args []string) {
+	db, _ := openDB(args, "stats DB", 0, 0)
+	defer db.Close()
+
+	st, err := db.Stats(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	algos := make([]string, 0, len(st.Algos))
+	for algo, n := range st.Algos {
+		algos = append(algos, fmt.Sprintf("%s %d", algo, n))
+	}
+	sort.Strings(algos)
+
+	//nolint:forbidigo
+	{
+		fmt.Printf("Schema version: %d\n", st.Version)
+		fmt.Printf("Size:           %d bytes\n", st.Size)
+		if root := db.Root(); root != "" {
+			fmt.Printf("Library root:   %s\n", root)
+		}
+		fmt.Printf("Entries:        %d", st.Entries)
+		if len(algos) > 0 {
+			fmt.Printf(" (%s)", strings.Join(algos, ", "))
+		}
+		fmt.Println()
+		fmt.Printf("Variants:       %d\n", st.Variants)
+		fmt.Printf("Checksums:      %d\n", st.Checksums)
+		if st.Entries > 0 {
+			fmt.Printf("Oldest:         %s %s\n", formatTime(st.Oldest.Lastmod), st.Oldest.Path)
+			fmt.Printf("Newest:         %s %s\n", formatTime(st.Newest.Lastmod), st.Newest.Path)
+		}
+	}
+}
+
+func dbList(args []string) {
+	db, args := openDB(args, "list DB [PATH]", 0, 1)
+	defer db.Close()
+
+	var path string
+	if len(args) > 0 {
+		path, _ = filepath.Abs(args[0])
+	}
+
+	err := db.List(context.Background(), path, func(e dupes.Entry) error {
+		_, err := fmt.Printf("%s %-9s %s %s\n", hexFP(e.FP), e.Algo, formatTime(e.Lastmod), e.Path) //nolint:forbidigo
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dbShow(args []string) {
+	db, args := openDB(args, "show DB PATH", 1, 1)
+	defer db.Close()
+
+	ctx := context.Background()
+	path, _ := filepath.Abs(args[0])
+	entries, err := db.Lookup(ctx, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(entries) == 0 {
+		log.Fatalf("%s: not in the database", path)
+	}
+
+	for i, e := range entries {
+		variants, err := db.GetVariants(ctx, e.Path, e.Algo, e.Lastmod)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		//nolint:forbidigo
+		{
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Path:        %s\n", e.Path)
+			fmt.Printf("Algorithm:   %s\n", e.Algo)
+			fmt.Printf("Fingerprint: %s\n", hexFP(e.FP))
+			fmt.Printf("Modified:    %s\n", formatTime(e.Lastmod))
+			if e.Orientation != 0 {
+				fmt.Printf("Orientation: %d\n", e.Orientation)
+			}
+			if e.Checksum != "" {
+				fmt.Printf("Checksum:    %s\n", e.Checksum)
+			}
+			for _, v := range variants {
+				fmt.Printf("Variant:     %s %s\n", hexFP(v.FP), v.Transform)
+			}
+		}
+	}
+}
+
+func dbForget(args []string) {
+	db, args := openDB(args, "forget DB PATH...", 1, -1)
+	defer db.Close()
+
+	var total int64
+	for _, arg := range args {
+		path, _ := filepath.Abs(arg)
+		n, err := db.Forget(context.Background(), path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		total += n
+	}
+	fmt.Printf("%d entries removed.\n", total) //nolint:forbidigo
+}
+
+func dbVacuum(args []string) {
+	db, _ := openDB(args, "vacuum DB", 0, 0)
+	defer db.Close()
+
+	if err := db.Vacuum(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dbCheck(args []string) {
+	db, _ := openDB(args, "check DB", 0, 0)
+	defer db.Close()
+
+	ctx := context.Background()
+	if err := db.IntegrityCheck(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	var n, missing, modified int
+	var last string
+	err := db.List(ctx, "", func(e dupes.Entry) error {
+		if e.Path == last {
+			return nil
+		}
+		last = e.Path
+		n++
+
+		fi, err := os.Stat(e.Path)
+		switch {
+		case os.IsNotExist(err):
+			missing++
+			fmt.Printf("missing  %s\n", e.Path) //nolint:forbidigo
+		case err != nil:
+			log.Warnf("WARNING: %v", err)
+		case fi.ModTime().UnixNano() != e.Lastmod:
+			modified++
+			fmt.Printf("modified %s\n", e.Path) //nolint:forbidigo
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%d files checked, %d missing, %d modified.\n", n, missing, modified) //nolint:forbidigo
+	if missing+modified > 0 {
+		fmt.Println("Use --prune to update the database.") //nolint:forbidigo
+	}
+}
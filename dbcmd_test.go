@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRewrite(t *testing.T) {
+	var f rewriteFlags
+	for _, v := range []string{"/mnt/nas/=/home/me/nas", "/mnt=/media"} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Set("/mnt"); err == nil {
+		t.Error("a rewrite without = is accepted")
+	}
+
+	for _, tc := range []struct{ in, out string }{
+		{"/mnt/nas/a.jpg", "/home/me/nas/a.jpg"},
+		{"/mnt/nas", "/home/me/nas"},
+		{"/mnt/nas2/a.jpg", "/media/nas2/a.jpg"},
+		{"/mntx/a.jpg", "/mntx/a.jpg"},
+	} {
+		if got := f.rewrite(tc.in); got != tc.out {
+			t.Errorf("rewrite(%s) = %s, want %s", tc.in, got, tc.out)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"gitlab.com/opennota/findimagedupes/dupes"
+)
+
+// absPath returns the absolute path of path, or path itself on error.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// loadDistinct returns a function which reports whether two files are
+// marked in db as not duplicates of each other.
+func loadDistinct(ctx context.Context, db dupes.FingerprintStore) (func(a, b dupes.File) bool, error) {
+	pairs, err := db.DistinctPairs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	marked := make(map[[2]string]bool, 2*len(pairs))
+	for _, p := range pairs {
+		marked[p] = true
+		marked[[2]string{p[1], p[0]}] = true
+	}
+	return func(a, b dupes.File) bool {
+		return marked[[2]string{absPath(a.Path), absPath(b.Path)}]
+	}, nil
+}
+
+// markPairsDistinct marks every two of the files at paths in db as not
+// duplicates of each other. It returns the number of pairs marked.
+func markPairsDistinct(ctx context.Context, db dupes.FingerprintStore, paths []string) (int, error) {
+	n := 0
+	for i := range paths {
+		for j := i + 1; j < len(paths); j++ {
+			if err := db.MarkDistinct(ctx, absPath(paths[i]), absPath(paths[j])); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
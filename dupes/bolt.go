@@ -0,0 +1,329 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A bolt database keeps the entries and the fingerprints of the transformed
+// images in the fingerprints and variants buckets, as JSON, under the
+// algorithm and the absolute path of the file separated by a NUL byte. The
+// distinct bucket has the pairs of files marked as not duplicates as keys,
+// their paths separated by a NUL byte.
+
+// boltVersion is the version of the layout of bolt databases.
+const boltVersion = 1
+
+var (
+	metaBucket         = []byte("meta")
+	fingerprintsBucket = []byte("fingerprints")
+	variantsBucket     = []byte("variants")
+	distinctBucket     = []byte("distinct")
+)
+
+// BoltDB is a fingerprint database backed by bbolt, a key-value store
+// written in pure Go; the package needs cgo for pHash all the same. It does
+// not support the library root, moved file detection and the db commands.
+type BoltDB struct {
+	db *bolt.DB
+}
+
+// boltVariants are the fingerprints of the transformed images of a file.
+type boltVariants struct {
+	Lastmod  int64
+	Variants []Variant
+}
+
+// OpenBolt opens or creates the bolt fingerprint database at path.
+func OpenBolt(path string) (*BoltDB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get([]byte("version")); v != nil {
+			version, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("invalid database version: %q", v)
+			}
+			if version > boltVersion {
+				return fmt.Errorf("the database version %d is newer than the supported one (%d); upgrade findimagedupes", version, boltVersion)
+			}
+		}
+		if err := meta.Put([]byte("version"), []byte(strconv.Itoa(boltVersion))); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{fingerprintsBucket, variantsBucket, distinctBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltDB{db: db}, nil
+}
+
+// boltKey returns the key of the entries for path computed by the algorithm
+// algo.
+func boltKey(path, algo string) []byte {
+	return []byte(algo + "\x00" + path)
+}
+
+// decodeEntry decodes the entry stored under the key k.
+func decodeEntry(k, v []byte) (Entry, error) {
+	var e Entry
+	if err := json.Unmarshal(v, &e); err != nil {
+		return e, err
+	}
+	i := bytes.IndexByte(k, 0)
+	if i < 0 {
+		return e, fmt.Errorf("invalid key: %q", k)
+	}
+	e.Algo, e.Path = string(k[:i]), string(k[i+1:])
+	return e, nil
+}
+
+// Get implements FingerprintStore.Get.
+func (db *BoltDB) Get(ctx context.Context, path, algo string, modtime int64) (Entry, bool, error) {
+	var e Entry
+	var ok bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		k := boltKey(path, algo)
+		v := tx.Bucket(fingerprintsBucket).Get(k)
+		if v == nil {
+			return nil
+		}
+		var err error
+		e, err = decodeEntry(k, v)
+		ok = err == nil && e.Lastmod == modtime
+		return err
+	})
+	if err != nil || !ok {
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// Upsert implements FingerprintStore.Upsert. Concurrent calls are written
+// in a single transaction.
+func (db *BoltDB) Upsert(ctx context.Context, e Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.db.Batch(func(tx *bolt.Tx) error {
+		return putEntry(tx, e)
+	})
+}
+
+// putEntry stores the entry in the transaction tx.
+func putEntry(tx *bolt.Tx, e Entry) error {
+	k := boltKey(e.Path, e.Algo)
+	e.Path, e.Algo = "", ""
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(fingerprintsBucket).Put(k, v)
+}
+
+// GetAll implements FingerprintStore.GetAll.
+func (db *BoltDB) GetAll(ctx context.Context, algo string) ([]Entry, error) {
+	var results []Entry
+	err := db.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(algo + "\x00")
+		c := tx.Bucket(fingerprintsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			e, err := decodeEntry(k, v)
+			if err != nil {
+				return err
+			}
+			results = append(results, e)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// GetVariants implements FingerprintStore.GetVariants.
+func (db *BoltDB) GetVariants(ctx context.Context, path, algo string, modtime int64) ([]Variant, error) {
+	var bv boltVariants
+	err := db.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(variantsBucket).Get(boltKey(path, algo))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &bv)
+	})
+	if err != nil || bv.Lastmod != modtime {
+		return nil, err
+	}
+	return bv.Variants, nil
+}
+
+// UpsertVariants implements FingerprintStore.UpsertVariants.
+func (db *BoltDB) UpsertVariants(ctx context.Context, path, algo string, modtime int64, variants []Variant) error {
+	v, err := json.Marshal(boltVariants{Lastmod: modtime, Variants: variants})
+	if err != nil {
+		return err
+	}
+	return db.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(variantsBucket).Put(boltKey(path, algo), v)
+	})
+}
+
+// Prune implements FingerprintStore.Prune.
+func (db *BoltDB) Prune(ctx context.Context, opts PruneOptions) (PruneStats, error) {
+	var st PruneStats
+	var last []byte
+	for {
+		var batch []Entry
+		err := db.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(fingerprintsBucket).Cursor()
+			k, v := c.First()
+			if last != nil {
+				if k, v = c.Seek(last); bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(batch) < pruneBatch; k, v = c.Next() {
+				last = append(last[:0], k...)
+				e, err := decodeEntry(k, v)
+				if err != nil {
+					return err
+				}
+				if opts.Under == "" || contains(opts.Under, e.Path) {
+					batch = append(batch, e)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return st, err
+		}
+		if len(batch) == 0 {
+			return st, nil
+		}
+
+		removed, refreshed := checkEntries(ctx, batch, func(path string) string { return path }, opts)
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		err = db.db.Update(func(tx *bolt.Tx) error {
+			for _, e := range removed {
+				if err := tx.Bucket(fingerprintsBucket).Delete(boltKey(e.Path, e.Algo)); err != nil {
+					return err
+				}
+			}
+			for _, e := range refreshed {
+				if err := putEntry(tx, e); err != nil {
+					return err
+				}
+			}
+			// The variants of the modified files are computed again
+			// on demand.
+			for _, e := range append(removed, refreshed...) {
+				if err := tx.Bucket(variantsBucket).Delete(boltKey(e.Path, e.Algo)); err != nil {
+					return err
+				}
+			}
+			return deleteDistinct(tx, removed)
+		})
+		if err != nil {
+			return st, err
+		}
+		st.Checked += len(batch)
+		st.Removed += len(removed)
+		st.Refreshed += len(refreshed)
+	}
+}
+
+// MarkDistinct implements FingerprintStore.MarkDistinct.
+func (db *BoltDB) MarkDistinct(ctx context.Context, a, b string) error {
+	p := distinctPair(a, b)
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(distinctBucket).Put([]byte(p[0]+"\x00"+p[1]), nil)
+	})
+}
+
+// DistinctPairs implements FingerprintStore.DistinctPairs.
+func (db *BoltDB) DistinctPairs(ctx context.Context) ([][2]string, error) {
+	var pairs [][2]string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(distinctBucket).ForEach(func(k, _ []byte) error {
+			i := bytes.IndexByte(k, 0)
+			if i < 0 {
+				return fmt.Errorf("invalid key: %q", k)
+			}
+			pairs = append(pairs, [2]string{string(k[:i]), string(k[i+1:])})
+			return nil
+		})
+	})
+	return pairs, err
+}
+
+// deleteDistinct removes the distinct marks of the files of the entries.
+func deleteDistinct(tx *bolt.Tx, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	paths := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		paths[e.Path] = true
+	}
+
+	b := tx.Bucket(distinctBucket)
+	var keys [][]byte
+	err := b.ForEach(func(k, _ []byte) error {
+		i := bytes.IndexByte(k, 0)
+		if i >= 0 && (paths[string(k[:i])] || paths[string(k[i+1:])]) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (db *BoltDB) Close() error {
+	return db.db.Close()
+}
@@ -0,0 +1,85 @@
+package dupes
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbpath := filepath.Join(dir, "fp.bolt")
+	store, err := OpenStore(dbpath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*BoltDB); !ok {
+		t.Fatalf("got %T, want *BoltDB", store)
+	}
+
+	ctx := context.Background()
+	a := Entry{Path: filepath.Join(dir, "a.jpg"), Algo: "dct", FP: 1, Lastmod: 10, Size: 100, Checksum: "abc"}
+	b := Entry{Path: filepath.Join(dir, "b.jpg"), Algo: "dct", FP: 2, Lastmod: 10}
+	for _, e := range []Entry{a, b, {Path: a.Path, Algo: "ahash", FP: 3, Lastmod: 10}} {
+		if err := store.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	variants := []Variant{{Transform: 1, FP: 4}}
+	if err := store.UpsertVariants(ctx, a.Path, "dct", 10, variants); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, ok, err := store.Get(ctx, a.Path, "dct", 10); err != nil || !ok || e != a {
+		t.Errorf("Get: got %+v, %v, %v; want %+v", e, ok, err, a)
+	}
+	if _, ok, err := store.Get(ctx, a.Path, "dct", 11); err != nil || ok {
+		t.Errorf("Get of a modified file: got %v, %v", ok, err)
+	}
+	if all, err := store.GetAll(ctx, "dct"); err != nil || !reflect.DeepEqual(all, []Entry{a, b}) {
+		t.Errorf("GetAll: got %+v, %v", all, err)
+	}
+	if v, err := store.GetVariants(ctx, a.Path, "dct", 10); err != nil || !reflect.DeepEqual(v, variants) {
+		t.Errorf("GetVariants: got %v, %v", v, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBolt(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := ioutil.WriteFile(b.Path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(b.Path, time.Unix(0, b.Lastmod), time.Unix(0, b.Lastmod)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkDistinct(ctx, a.Path, b.Path); err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.Prune(ctx, PruneOptions{Under: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (PruneStats{Checked: 3, Removed: 2}); st != want {
+		t.Errorf("Prune: got %+v, want %+v", st, want)
+	}
+	if v, err := store.GetVariants(ctx, a.Path, "dct", 10); err != nil || v != nil {
+		t.Errorf("GetVariants of a removed file: got %v, %v", v, err)
+	}
+	if pairs, err := store.DistinctPairs(ctx); err != nil || len(pairs) != 0 {
+		t.Errorf("DistinctPairs after the removal of a file: got %v, %v", pairs, err)
+	}
+}
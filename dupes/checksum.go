@@ -0,0 +1,135 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// exactDupes computes the checksums of the files of the same size as
+// another one. It returns the requests for the files to be fingerprinted,
+// with only the first of every set of byte-identical files, and the requests
+// for the other ones by checksum.
+func (f *Finder) exactDupes(ctx context.Context, reqs []request) ([]request, map[string][]request) {
+	bySize := make(map[int64][]int)
+	for i, r := range reqs {
+		bySize[r.size] = append(bySize[r.size], i)
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < f.opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				reqs[i].checksum = f.checksum(ctx, reqs[i])
+			}
+		}()
+	}
+
+loop:
+	for _, idx := range bySize {
+		if len(idx) < 2 {
+			continue
+		}
+		for _, i := range idx {
+			if f.opts.Progress != nil {
+				f.opts.Progress(reqs[i].path)
+			}
+			select {
+			case <-ctx.Done():
+				break loop
+			case work <- i:
+			}
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	copies := make(map[string][]request)
+	seen := make(map[string]bool)
+	uniq := reqs[:0]
+	for _, r := range reqs {
+		if r.checksum != "" {
+			if seen[r.checksum] {
+				copies[r.checksum] = append(copies[r.checksum], r)
+				continue
+			}
+			seen[r.checksum] = true
+		}
+		uniq = append(uniq, r)
+	}
+
+	return uniq, copies
+}
+
+// checksum returns the checksum of the file of the request r, from the
+// fingerprint database if it is there; an empty string on error.
+func (f *Finder) checksum(ctx context.Context, r request) string {
+	db := f.opts.DB
+	var e Entry
+	var cached bool
+	if db != nil {
+		abspath, _ := filepath.Abs(r.path)
+		var err error
+		e, cached, err = db.Get(ctx, abspath, f.opts.Hasher.Name(), r.modTime)
+		switch {
+		case err == context.Canceled:
+			return ""
+		case err != nil:
+			f.opts.Log.Errorf("ERROR: %v", err)
+		}
+		if e.Checksum != "" {
+			return e.Checksum
+		}
+	}
+
+	sum, err := fileChecksum(r.path)
+	if err != nil {
+		f.opts.Log.Warnf("WARNING: %s: %v", r.path, err)
+		return ""
+	}
+
+	if cached && !f.opts.NewOnly {
+		e.Size = r.size
+		e.Checksum = sum
+		if err := db.Upsert(ctx, e); err != nil && err != context.Canceled {
+			f.opts.Log.Errorf("ERROR: %v", err)
+		}
+	}
+
+	return sum
+}
+
+// fileChecksum returns the SHA-256 checksum of the file at path, in hex.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,270 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Entry is a single record of the fingerprint database.
+type Entry struct {
+	Path    string
+	Algo    string
+	FP      uint64
+	Lastmod int64
+
+	// Size is the size of the file in bytes; 0 if it is not known.
+	Size int64
+
+	// Orientation is the EXIF orientation the image was turned upright
+	// from before it was fingerprinted; 0 if it was not looked at.
+	Orientation int
+
+	// Checksum is the SHA-256 checksum of the file, in hex, if it was
+	// computed.
+	Checksum string
+
+	// Inode, Dev and Partial identify the file when it is moved: its
+	// inode and device numbers, and the checksum of its beginning and
+	// end.
+	Inode, Dev uint64
+	Partial    string
+}
+
+// DB is a fingerprint database backed by SQLite.
+type DB struct {
+	db          *sql.DB
+	root        string // Library root; see root.go.
+	preparedGet *sql.Stmt
+	mu          sync.RWMutex       // Protects following.
+	pending     map[entryKey]Entry // Entries not written yet; see writer.go.
+	err         error              // Error writing pending entries.
+	wmu         sync.Mutex         // Serializes the writes to the database.
+	flush       chan struct{}      // Wakes up the writer.
+	done        chan struct{}      // Closed when the writer exits.
+}
+
+// OpenDatabase opens or creates the fingerprint database at dbpath. The
+// databases created by older versions are upgraded; those created by newer
+// ones are refused.
+func OpenDatabase(dbpath string) (*DB, error) {
+	db, err := sql.Open("sqlite3", dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let the readers proceed while the entries are written.
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, _, err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	root, err := getMeta(context.Background(), db, "root")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	get, err := db.Prepare("SELECT " + entryColumns + " FROM fingerprints WHERE path = ? AND algo = ? AND lastmod = ?") //nolint:sqlclosecheck
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	d := &DB{
+		db:          db,
+		root:        root,
+		preparedGet: get,
+		pending:     make(map[entryKey]Entry),
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	go d.writer()
+	return d, nil
+}
+
+// Get returns the entry for the fingerprint computed by the algorithm algo
+// stored for path, provided that the file has not been modified since.
+func (db *DB) Get(ctx context.Context, path, algo string, modtime int64) (Entry, bool, error) {
+	key := db.key(path)
+	db.mu.RLock()
+	e, ok := db.pending[entryKey{key, algo}]
+	db.mu.RUnlock()
+	if ok && e.Lastmod == modtime {
+		e.Path = path
+		return e, true, nil
+	}
+
+	e, err := scanEntry(db.preparedGet.QueryRowContext(ctx, key, algo, modtime))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+	e.Path = path
+	return e, true, nil
+}
+
+const entryColumns = "path, algo, fp, lastmod, size, orientation, checksum, inode, dev, partial"
+
+// entryValues are the placeholders for entryColumns.
+const entryValues = "?, ?, ?, ?, ?, ?, ?, ?, ?, ?"
+
+// scanEntry scans a row of entryColumns.
+func scanEntry(row interface{ Scan(...interface{}) error }) (Entry, error) {
+	var e Entry
+	var fp int64
+	var size, orientation, inode, dev sql.NullInt64
+	var checksum, partial sql.NullString
+	if err := row.Scan(&e.Path, &e.Algo, &fp, &e.Lastmod, &size, &orientation, &checksum, &inode, &dev, &partial); err != nil {
+		return e, err
+	}
+	e.FP = uint64(fp)
+	e.Size = size.Int64
+	e.Orientation = int(orientation.Int64)
+	e.Checksum = checksum.String
+	e.Inode, e.Dev = uint64(inode.Int64), uint64(dev.Int64)
+	e.Partial = partial.String
+	return e, nil
+}
+
+// values returns the values of entryColumns for e stored under key.
+func (e Entry) values(key string) []interface{} {
+	null := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+	return []interface{}{
+		key, e.Algo, int64(e.FP), e.Lastmod, e.Size, e.Orientation, null(e.Checksum),
+		int64(e.Inode), int64(e.Dev), null(e.Partial),
+	}
+}
+
+// GetAll returns all the entries of the database computed by the algorithm
+// algo.
+func (db *DB) GetAll(ctx context.Context, algo string) ([]Entry, error) {
+	if err := db.flushPending(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, "SELECT path, fp FROM fingerprints WHERE algo = ?", algo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Entry
+	for rows.Next() {
+		var path string
+		var fp int64
+		if err := rows.Scan(&path, &fp); err != nil {
+			return nil, err
+		}
+		results = append(results, Entry{Path: db.resolve(path), Algo: algo, FP: uint64(fp)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Upsert stores the entry. The entries are written in batches in the
+// background; an error writing them is returned by a later call to Upsert
+// or by Close.
+func (db *DB) Upsert(ctx context.Context, e Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	e.Path = db.key(e.Path)
+	db.mu.Lock()
+	db.pending[entryKey{e.Path, e.Algo}] = e
+	n := len(db.pending)
+	err := db.err
+	db.err = nil
+	db.mu.Unlock()
+
+	if n >= writeBatch {
+		select {
+		case db.flush <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// GetVariants returns the fingerprints of the transformed images computed by
+// the algorithm algo stored for path, provided that the file has not been
+// modified since.
+func (db *DB) GetVariants(ctx context.Context, path, algo string, modtime int64) ([]Variant, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT transform, fp FROM variants WHERE path = ? AND algo = ? AND lastmod = ?", db.key(path), algo, modtime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []Variant
+	for rows.Next() {
+		var t int
+		var fp int64
+		if err := rows.Scan(&t, &fp); err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{Transform: Transform(t), FP: uint64(fp)})
+	}
+	return variants, rows.Err()
+}
+
+// UpsertVariants stores the fingerprints of the transformed images of path
+// computed by the algorithm algo.
+func (db *DB) UpsertVariants(ctx context.Context, path, algo string, modtime int64, variants []Variant) error {
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	key := db.key(path)
+	for _, v := range variants {
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO variants (path, algo, transform, fp, lastmod) VALUES (?, ?, ?, ?, ?)",
+			key, algo, int(v.Transform), int64(v.FP), modtime); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Close writes the pending entries and closes the database.
+func (db *DB) Close() error {
+	close(db.flush)
+	<-db.done
+	_ = db.preparedGet.Close()
+	if err := db.db.Close(); err != nil {
+		return err
+	}
+	return db.err
+}
@@ -0,0 +1,402 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Stats are the statistics of a fingerprint database.
+type Stats struct {
+	Version   int            // Schema version.
+	Size      int64          // Size of the database, in bytes.
+	Entries   int            // Number of fingerprints.
+	Algos     map[string]int // Number of fingerprints by hash algorithm.
+	Variants  int            // Number of fingerprints of transformed images.
+	Checksums int            // Number of entries with a checksum.
+
+	// Oldest and Newest are the entries of the files with the earliest
+	// and the latest modification times.
+	Oldest, Newest Entry
+}
+
+// Stats returns the statistics of the database.
+func (db *DB) Stats(ctx context.Context) (Stats, error) {
+	if err := db.flushPending(); err != nil {
+		return Stats{}, err
+	}
+
+	var st Stats
+	var err error
+	if st.Version, err = schemaVersion(db.db); err != nil {
+		return st, err
+	}
+
+	var pages, pageSize int64
+	if err := db.db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pages); err != nil {
+		return st, err
+	}
+	if err := db.db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return st, err
+	}
+	st.Size = pages * pageSize
+
+	rows, err := db.db.QueryContext(ctx, "SELECT algo, count(*), count(checksum) FROM fingerprints GROUP BY algo")
+	if err != nil {
+		return st, err
+	}
+	defer rows.Close()
+
+	st.Algos = make(map[string]int)
+	for rows.Next() {
+		var algo string
+		var n, checksums int
+		if err := rows.Scan(&algo, &n, &checksums); err != nil {
+			return st, err
+		}
+		st.Algos[algo] = n
+		st.Entries += n
+		st.Checksums += checksums
+	}
+	if err := rows.Err(); err != nil {
+		return st, err
+	}
+
+	if err := db.db.QueryRowContext(ctx, "SELECT count(*) FROM variants").Scan(&st.Variants); err != nil {
+		return st, err
+	}
+
+	if st.Entries == 0 {
+		return st, nil
+	}
+	if st.Oldest, err = db.entry(ctx, "ORDER BY lastmod LIMIT 1"); err != nil {
+		return st, err
+	}
+	if st.Newest, err = db.entry(ctx, "ORDER BY lastmod DESC LIMIT 1"); err != nil {
+		return st, err
+	}
+	st.Oldest.Path = db.resolve(st.Oldest.Path)
+	st.Newest.Path = db.resolve(st.Newest.Path)
+
+	return st, nil
+}
+
+func (db *DB) entry(ctx context.Context, clause string) (Entry, error) {
+	return scanEntry(db.db.QueryRowContext(ctx, "SELECT "+entryColumns+" FROM fingerprints "+clause))
+}
+
+// under returns an SQL condition matching the keys of path and the paths
+// under it in the column col, and its arguments.
+func (db *DB) under(col, path string) (string, []interface{}) {
+	key := db.key(path)
+	if !filepath.IsAbs(key) {
+		if key == "." {
+			return "substr(" + col + ", 1, 1) <> ?", []interface{}{string(filepath.Separator)}
+		}
+		return prefixCond(col, key, '/')
+	}
+
+	cond, args := prefixCond(col, path, filepath.Separator)
+	if db.root != "" && contains(path, db.root) {
+		// Also match the paths relative to the root.
+		cond = "(" + cond + " OR substr(" + col + ", 1, 1) <> ?)"
+		args = append(args, string(filepath.Separator))
+	}
+	return cond, args
+}
+
+// prefixCond returns an SQL condition matching path and the paths under it
+// in the column col, and its arguments.
+func prefixCond(col, path string, sep rune) (string, []interface{}) {
+	// The paths under dir sort between dir+"/" and dir+"0".
+	dir := strings.TrimSuffix(path, string(sep))
+	return "(" + col + " = ? OR (" + col + " >= ? AND " + col + " < ?))", []interface{}{
+		dir,
+		dir + string(sep),
+		dir + string(sep+1),
+	}
+}
+
+// contains reports whether path is dir or is under it.
+func contains(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// List calls fn with every entry for path and the paths under it, ordered
+// by path; with every entry if path is empty.
+func (db *DB) List(ctx context.Context, path string, fn func(Entry) error) error {
+	if err := db.flushPending(); err != nil {
+		return err
+	}
+
+	q := "SELECT " + entryColumns + " FROM fingerprints"
+	var args []interface{}
+	if path != "" {
+		var cond string
+		cond, args = db.under("path", path)
+		q += " WHERE " + cond
+	}
+	q += " ORDER BY path, algo"
+
+	rows, err := db.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return err
+		}
+		e.Path = db.resolve(e.Path)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Lookup returns the entries for path, whatever the modification time of
+// the file.
+func (db *DB) Lookup(ctx context.Context, path string) ([]Entry, error) {
+	if err := db.flushPending(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, "SELECT "+entryColumns+" FROM fingerprints WHERE path = ? ORDER BY algo", db.key(path))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		e.Path = path
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Forget removes the entries and the distinct marks for path and the paths
+// under it. It returns the number of fingerprints removed, not counting those
+// of the transformed images.
+func (db *DB) Forget(ctx context.Context, path string) (int64, error) {
+	if err := db.flushPending(); err != nil {
+		return 0, err
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	cond, args := db.under("path", path)
+	res, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE "+cond, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM variants WHERE "+cond, args...); err != nil {
+		return 0, err
+	}
+	for _, col := range []string{"a", "b"} {
+		cond, args := db.under(col, path)
+		if _, err := tx.ExecContext(ctx, "DELETE FROM distinct_pairs WHERE "+cond, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, tx.Commit()
+}
+
+// Vacuum rebuilds the database file, reclaiming the unused space.
+func (db *DB) Vacuum(ctx context.Context) error {
+	if err := db.flushPending(); err != nil {
+		return err
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+	_, err := db.db.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// IntegrityCheck verifies the integrity of the database file.
+func (db *DB) IntegrityCheck(ctx context.Context) error {
+	rows, err := db.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return err
+		}
+		if s != "ok" {
+			problems = append(problems, s)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database is corrupt: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// readOnlyURI returns the URI which opens the SQLite database at path
+// read-only.
+func readOnlyURI(path string) (string, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abspath), RawQuery: "mode=ro"}
+	return u.String(), nil
+}
+
+// MergeableAlgos returns the hash algorithms of the fingerprints in the
+// database at path, which is checked to be mergeable. The database is opened
+// read-only and is not migrated.
+func MergeableAlgos(path string) ([]string, error) {
+	uri, err := readOnlyURI(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if version != SchemaVersion() {
+		return nil, fmt.Errorf("schema version %d, not %d; migrate the database first", version, SchemaVersion())
+	}
+
+	rows, err := db.Query("SELECT DISTINCT algo FROM fingerprints ORDER BY algo")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var algos []string
+	for rows.Next() {
+		var algo string
+		if err := rows.Scan(&algo); err != nil {
+			return nil, err
+		}
+		algos = append(algos, algo)
+	}
+	return algos, rows.Err()
+}
+
+// Merge adds the entries of the fingerprint database at path, which is only
+// read, replacing those of the files modified earlier. It returns the number
+// of entries added or replaced.
+func (db *DB) Merge(ctx context.Context, path string) (int64, error) {
+	if err := db.flushPending(); err != nil {
+		return 0, err
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	// The attached database is only visible on the connection.
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	uri, err := readOnlyURI(path)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS src", uri); err != nil {
+		return 0, err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), "DETACH DATABASE src")
+	}()
+
+	// The relative paths are only the same files if the roots are.
+	var version int
+	if err := conn.QueryRowContext(ctx, "SELECT version FROM src.schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	if version != SchemaVersion() {
+		return 0, fmt.Errorf("schema version %d, not %d; migrate the database first", version, SchemaVersion())
+	}
+	var root string
+	err = conn.QueryRowContext(ctx, "SELECT value FROM src.meta WHERE key = 'root'").Scan(&root)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if root != db.root {
+		return 0, fmt.Errorf("library root %q, not %q", root, db.root)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO fingerprints ("+entryColumns+") SELECT "+entryColumns+" FROM src.fingerprints s"+
+		" WHERE NOT EXISTS (SELECT 1 FROM fingerprints f WHERE f.path = s.path AND f.algo = s.algo AND f.lastmod >= s.lastmod)")
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO variants (path, algo, transform, fp, lastmod) SELECT path, algo, transform, fp, lastmod FROM src.variants s"+
+		" WHERE NOT EXISTS (SELECT 1 FROM variants v WHERE v.path = s.path AND v.algo = s.algo AND v.transform = s.transform AND v.lastmod >= s.lastmod)"); err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
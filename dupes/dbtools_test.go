@@ -0,0 +1,112 @@
+package dupes
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestDB opens a new database; the returned function closes and
+// removes it.
+func openTestDB(t *testing.T) (*DB, func()) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(filepath.Join(dir, "fp.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestForget(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, path := range []string{"/a/b", "/a/b.jpg", "/a/b/c.jpg", "/a/b/d/e.jpg", "/a/bc.jpg"} {
+		if err := db.Upsert(ctx, Entry{Path: path, Algo: "dct", FP: 1, Lastmod: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.Forget(ctx, "/a/b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("%d entries removed, want 3", n)
+	}
+
+	var paths []string
+	if err := db.List(ctx, "", func(e Entry) error {
+		paths = append(paths, e.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/a/b.jpg", "/a/bc.jpg"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dst, done := openTestDB(t)
+	defer done()
+	src, done2 := openTestDB(t)
+	defer done2()
+
+	ctx := context.Background()
+	for _, e := range []Entry{
+		{Path: "/a.jpg", Algo: "dct", FP: 1, Lastmod: 10},
+		{Path: "/b.jpg", Algo: "dct", FP: 2, Lastmod: 10},
+	} {
+		if err := dst.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range []Entry{
+		{Path: "/a.jpg", Algo: "dct", FP: 10, Lastmod: 5},
+		{Path: "/b.jpg", Algo: "dct", FP: 20, Lastmod: 20},
+		{Path: "/c.jpg", Algo: "dct", FP: 30, Lastmod: 20},
+	} {
+		if err := src.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := src.flushPending(); err != nil {
+		t.Fatal(err)
+	}
+
+	var srcPath string
+	if err := src.db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&srcPath); err != nil {
+		t.Fatal(err)
+	}
+	n, err := dst.Merge(ctx, srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d entries merged, want 2", n)
+	}
+
+	var fps []uint64
+	if err := dst.List(ctx, "", func(e Entry) error {
+		fps = append(fps, e.FP)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{1, 20, 30}; !reflect.DeepEqual(fps, want) {
+		t.Errorf("got %v, want %v", fps, want)
+	}
+}
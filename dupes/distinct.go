@@ -0,0 +1,55 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import "context"
+
+// distinctPair returns the pair of a and b in the order they are stored in.
+func distinctPair(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// MarkDistinct records that the files at the paths a and b are not
+// duplicates of each other.
+func (db *DB) MarkDistinct(ctx context.Context, a, b string) error {
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	p := distinctPair(db.key(a), db.key(b))
+	_, err := db.db.ExecContext(ctx, "INSERT OR IGNORE INTO distinct_pairs (a, b) VALUES (?, ?)", p[0], p[1])
+	return err
+}
+
+// DistinctPairs returns the pairs of paths of the files marked as not
+// duplicates of each other.
+func (db *DB) DistinctPairs(ctx context.Context) ([][2]string, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT a, b FROM distinct_pairs ORDER BY a, b")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs [][2]string
+	for rows.Next() {
+		var a, b string
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]string{db.resolve(a), db.resolve(b)})
+	}
+	return pairs, rows.Err()
+}
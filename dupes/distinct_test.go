@@ -0,0 +1,30 @@
+package dupes
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDistinctPairs(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, p := range [][2]string{{"/b.jpg", "/a.jpg"}, {"/a.jpg", "/b.jpg"}, {"/b.jpg", "/c.jpg"}} {
+		if err := db.MarkDistinct(ctx, p[0], p[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Rename(ctx, "/b.jpg", "/d.jpg", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, err := db.DistinctPairs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]string{{"/a.jpg", "/d.jpg"}, {"/d.jpg", "/c.jpg"}}; !reflect.DeepEqual(pairs, want) {
+		t.Errorf("got %v, want %v", pairs, want)
+	}
+}
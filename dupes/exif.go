@@ -0,0 +1,147 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const orientationTag = 0x0112
+
+var errNoExif = errors.New("no EXIF orientation")
+
+// orientationTransforms are the transforms which display an image with the
+// given EXIF orientation upright.
+var orientationTransforms = [...]Transform{
+	1: Identity,
+	2: FlipH,
+	3: Rotate180,
+	4: FlipV,
+	5: Transpose,
+	6: Rotate90,
+	7: Transverse,
+	8: Rotate270,
+}
+
+// exifOrientation returns the EXIF orientation (1..8) of the JPEG or TIFF
+// image at path; 1, the upright orientation, if there is none.
+func exifOrientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+
+	o, err := readOrientation(bufio.NewReader(f))
+	if err != nil || o < 1 || o >= len(orientationTransforms) {
+		return 1
+	}
+	return o
+}
+
+func readOrientation(r *bufio.Reader) (int, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte("II*\x00")) || bytes.Equal(magic, []byte("MM\x00*")):
+		// The IFD may be anywhere in a TIFF file; only look at the
+		// beginning of it.
+		tiff, err := ioutil.ReadAll(io.LimitReader(r, 1<<16))
+		if err != nil {
+			return 0, err
+		}
+		return tiffOrientation(tiff)
+	case magic[0] != 0xff || magic[1] != 0xd8:
+		return 0, errNoExif
+	}
+
+	// Look for the APP1 segment of the JPEG file.
+	if _, err := r.Discard(2); err != nil {
+		return 0, err
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return 0, err
+		}
+		if hdr[0] != 0xff {
+			return 0, errNoExif
+		}
+		marker := hdr[1]
+		length := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 || marker == 0xda { // Start of scan.
+			return 0, errNoExif
+		}
+
+		if marker != 0xe1 {
+			if _, err := r.Discard(length); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return 0, err
+		}
+		if !bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			continue
+		}
+		return tiffOrientation(seg[6:])
+	}
+}
+
+// tiffOrientation returns the orientation tag of the first IFD of the TIFF
+// structure b.
+func tiffOrientation(b []byte) (int, error) {
+	if len(b) < 8 {
+		return 0, errNoExif
+	}
+
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errNoExif
+	}
+
+	off := int(order.Uint32(b[4:]))
+	if off < 8 || off+2 > len(b) {
+		return 0, errNoExif
+	}
+	n := int(order.Uint16(b[off:]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(b) {
+			break
+		}
+		if order.Uint16(b[e:]) == orientationTag {
+			return int(order.Uint16(b[e+8:])), nil
+		}
+	}
+
+	return 0, errNoExif
+}
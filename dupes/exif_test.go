@@ -0,0 +1,141 @@
+package dupes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOrientation(t *testing.T) {
+	// A big-endian TIFF structure with a single IFD entry: orientation 6.
+	tiffMM := []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	// The same, little-endian, with orientation 8.
+	tiffII := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00")
+
+	segment := func(marker byte, data []byte) []byte {
+		n := len(data) + 2
+		return append([]byte{0xff, marker, byte(n >> 8), byte(n)}, data...)
+	}
+	jpeg := func(segs ...[]byte) []byte {
+		b := []byte{0xff, 0xd8}
+		for _, s := range segs {
+			b = append(b, s...)
+		}
+		return append(b, segment(0xda, nil)...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"tiff", tiffII, 8},
+		{"jpeg", jpeg(segment(0xe0, []byte("JFIF\x00\x01\x02")), segment(0xe1, append([]byte("Exif\x00\x00"), tiffMM...))), 6},
+		{"jpeg without exif", jpeg(segment(0xe0, []byte("JFIF\x00\x01\x02"))), 0},
+		{"xmp", jpeg(segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00"))), 0},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), 0},
+	} {
+		o, _ := readOrientation(bufio.NewReader(bytes.NewReader(tc.data)))
+		if o != tc.want {
+			t.Errorf("%s: got orientation %d, want %d", tc.name, o, tc.want)
+		}
+	}
+}
+
+func TestFingerprintOrientation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An upright copy, and a camera original stored turned to the left
+	// with orientation 6.
+	img := testImage(64, 48, false)
+	upright := filepath.Join(dir, "upright.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(upright, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := jpeg.Encode(&buf, Rotate270.Apply(img), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	tiffMM := []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	exif := append([]byte("Exif\x00\x00"), tiffMM...)
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(exif) + 2)}, exif...)
+	data := append(append([]byte{0xff, 0xd8}, app1...), buf.Bytes()[2:]...)
+	original := filepath.Join(dir, "original.jpg")
+	if err := ioutil.WriteFile(original, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := HashFile(DCT{}, upright)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, o, err := fingerprint(DCT{}, original, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o != 6 {
+		t.Errorf("got orientation %d, want 6", o)
+	}
+	if d := bits.OnesCount64(fp ^ want); d > 4 {
+		t.Errorf("the fingerprints of the original and the upright copy are %d bits apart", d)
+	}
+}
+
+func TestFinderOrientationUnknown(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(64, 48, false)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "a.png")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry stored before the orientation was, with a fingerprint
+	// which the file would not be hashed to.
+	ctx := context.Background()
+	const fp = 0x0123456789abcdef
+	e := Entry{Path: path, Algo: "ahash", FP: fp, Lastmod: fi.ModTime().UnixNano()}
+	if err := db.Upsert(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := NewFinder(Options{Depth: -1, Hasher: AHash{}, DB: db}).Scan(ctx, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].FP != fp {
+		t.Errorf("the file is fingerprinted again: got %+v", files)
+	}
+	if e, ok, err := db.Get(ctx, path, "ahash", e.Lastmod); err != nil || !ok || e.Orientation != 1 {
+		t.Errorf("got %+v, %v, %v; want orientation 1", e, ok, err)
+	}
+}
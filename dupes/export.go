@@ -0,0 +1,181 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// record is an entry of the fingerprint database as exported to NDJSON.
+type record struct {
+	Path        string `json:"path"`
+	Algo        string `json:"algo"`
+	FP          string `json:"fp"`
+	Lastmod     int64  `json:"lastmod"`
+	Size        int64  `json:"size"`
+	Orientation int    `json:"orientation,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	Partial     string `json:"partial,omitempty"`
+}
+
+// Export writes the entries for path and the paths under it, or every entry
+// if path is empty, to w as newline-delimited JSON. It returns the number of
+// entries written.
+func (db *DB) Export(ctx context.Context, w io.Writer, path string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	err := db.List(ctx, path, func(e Entry) error {
+		n++
+		return enc.Encode(record{
+			Path:        e.Path,
+			Algo:        e.Algo,
+			FP:          fmt.Sprintf("%016x", e.FP),
+			Lastmod:     e.Lastmod,
+			Size:        e.Size,
+			Orientation: e.Orientation,
+			Checksum:    e.Checksum,
+			Partial:     e.Partial,
+		})
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Conflict is the policy for the imported entries of the files already in
+// the database.
+type Conflict int
+
+const (
+	// KeepNewer keeps the entry of the most recently modified file.
+	KeepNewer Conflict = iota
+
+	// Overwrite replaces the entry in the database.
+	Overwrite
+
+	// Skip keeps the entry in the database.
+	Skip
+)
+
+// Conflicts lists the names accepted by ParseConflict.
+var Conflicts = []string{"keep-newer", "overwrite", "skip"}
+
+// ParseConflict returns the conflict policy with the given name.
+func ParseConflict(name string) (Conflict, error) {
+	for i, n := range Conflicts {
+		if n == name {
+			return Conflict(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy: %s", name)
+}
+
+// ImportOptions configure Import.
+type ImportOptions struct {
+	// Conflict is the policy for the entries of the files already in
+	// the database.
+	Conflict Conflict
+
+	// Rewrite, if not nil, maps the paths of the imported entries to
+	// those they are stored under.
+	Rewrite func(path string) string
+}
+
+// Import reads the entries written by Export from r and stores them. It
+// returns the numbers of entries stored and of those skipped because of
+// conflicts.
+func (db *DB) Import(ctx context.Context, r io.Reader, opts ImportOptions) (int, int, error) {
+	if err := db.flushPending(); err != nil {
+		return 0, 0, err
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	get, err := tx.PrepareContext(ctx, "SELECT lastmod FROM fingerprints WHERE path = ? AND algo = ?")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer get.Close()
+	upsert, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO fingerprints ("+entryColumns+") VALUES ("+entryValues+")")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer upsert.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	stored, skipped := 0, 0
+	for line := 1; ; line++ {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("record %d: %v", line, err)
+		}
+
+		fp, err := strconv.ParseUint(rec.FP, 16, 64)
+		if err != nil || rec.Path == "" || rec.Algo == "" {
+			return 0, 0, fmt.Errorf("record %d: invalid entry", line)
+		}
+		if opts.Rewrite != nil {
+			rec.Path = opts.Rewrite(rec.Path)
+		}
+		key := db.key(rec.Path)
+
+		if opts.Conflict != Overwrite {
+			var lastmod int64
+			err := get.QueryRowContext(ctx, key, rec.Algo).Scan(&lastmod)
+			switch {
+			case err == sql.ErrNoRows:
+			case err != nil:
+				return 0, 0, err
+			case opts.Conflict == Skip || lastmod >= rec.Lastmod:
+				skipped++
+				continue
+			}
+		}
+
+		e := Entry{
+			Algo:        rec.Algo,
+			FP:          fp,
+			Lastmod:     rec.Lastmod,
+			Size:        rec.Size,
+			Orientation: rec.Orientation,
+			Checksum:    rec.Checksum,
+			Partial:     rec.Partial,
+		}
+		if _, err := upsert.ExecContext(ctx, e.values(key)...); err != nil {
+			return 0, 0, err
+		}
+		stored++
+	}
+
+	return stored, skipped, tx.Commit()
+}
@@ -0,0 +1,61 @@
+package dupes
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	src, done := openTestDB(t)
+	defer done()
+	dst, done2 := openTestDB(t)
+	defer done2()
+
+	ctx := context.Background()
+	for _, e := range []Entry{
+		{Path: "/nas/a.jpg", Algo: "dct", FP: 0xfedcba9876543210, Lastmod: 10, Size: 100, Checksum: "abc"},
+		{Path: "/nas/b.jpg", Algo: "dct", FP: 2, Lastmod: 10, Size: 200, Orientation: 6},
+		{Path: "/nas/c.jpg", Algo: "dct", FP: 3, Lastmod: 10},
+	} {
+		if err := src.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b.jpg is older here, c.jpg newer.
+	for _, e := range []Entry{
+		{Path: "/home/nas/b.jpg", Algo: "dct", FP: 20, Lastmod: 5},
+		{Path: "/home/nas/c.jpg", Algo: "dct", FP: 30, Lastmod: 20},
+	} {
+		if err := dst.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if n, err := src.Export(ctx, &buf, ""); err != nil || n != 3 {
+		t.Fatalf("exported %d entries: %v", n, err)
+	}
+
+	stored, skipped, err := dst.Import(ctx, &buf, ImportOptions{
+		Rewrite: func(path string) string { return strings.Replace(path, "/nas/", "/home/nas/", 1) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 2 || skipped != 1 {
+		t.Errorf("%d entries stored, %d skipped; want 2 and 1", stored, skipped)
+	}
+
+	for _, want := range []Entry{
+		{Path: "/home/nas/a.jpg", Algo: "dct", FP: 0xfedcba9876543210, Lastmod: 10, Size: 100, Checksum: "abc"},
+		{Path: "/home/nas/b.jpg", Algo: "dct", FP: 2, Lastmod: 10, Size: 200, Orientation: 6},
+		{Path: "/home/nas/c.jpg", Algo: "dct", FP: 30, Lastmod: 20},
+	} {
+		e, ok, err := dst.Get(ctx, want.Path, want.Algo, want.Lastmod)
+		if err != nil || !ok || e != want {
+			t.Errorf("got %+v, %v, %v; want %+v", e, ok, err, want)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package dupes finds visually similar or duplicate images.
+package dupes
+
+import (
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rakyll/magicmime"
+)
+
+// Logger receives the non-fatal warnings and errors.
+type Logger interface {
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Warnf(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+
+// Options configure a Finder.
+type Options struct {
+	// Threshold is the maximum Hamming distance (0..63) between the
+	// fingerprints of similar images.
+	Threshold int
+
+	// Cluster is the method of grouping similar images.
+	Cluster Cluster
+
+	// Depth is the number of directory levels to descend into below
+	// each root; 1 scans the roots only, a negative value means no limit.
+	Depth int
+
+	// Excludes are matched against every path; matching files are skipped.
+	Excludes []*regexp.Regexp
+
+	// Jobs is the number of images to process concurrently;
+	// runtime.NumCPU() if zero.
+	Jobs int
+
+	// Hasher is the hash algorithm; DCT if nil.
+	Hasher Hasher
+
+	// Transforms are the rotations and reflections of the images which
+	// are also fingerprinted, so that transformed copies of the images
+	// are found too.
+	Transforms []Transform
+
+	// IgnoreOrientation disables turning the images upright according
+	// to their EXIF orientation before fingerprinting them.
+	IgnoreOrientation bool
+
+	// DB, if not nil, is used to cache the fingerprints.
+	DB FingerprintStore
+
+	// NewOnly restricts the search to duplicates of the files under the
+	// roots, which are also looked for in DB; the new fingerprints are
+	// not added to DB.
+	NewOnly bool
+
+	// References are directories of trusted images, which are scanned
+	// like the roots; Find only reports the groups of both files under
+	// them and other files.
+	References []string
+
+	// Progress, if not nil, is called with every path visited, and again
+	// with those of the files as they are checksummed and fingerprinted.
+	Progress func(path string)
+
+	// Log, if not nil, receives the warnings and errors.
+	Log Logger
+}
+
+// File is a fingerprinted image.
+type File struct {
+	Path    string
+	FP      uint64
+	Size    int64
+	ModTime time.Time
+
+	// Root is the root under which the file was found; it is empty for
+	// the files found in the fingerprint database.
+	Root string
+
+	// Variants are the fingerprints of the transformed image, if
+	// Options.Transforms are set.
+	Variants []Variant
+
+	// Checksum is the SHA-256 checksum of the file, in hex. It is only
+	// computed for the files of the same size as another one.
+	Checksum string
+
+	// Reference reports whether the file was found under one of
+	// Options.References.
+	Reference bool
+}
+
+// Finder searches for duplicate images.
+type Finder struct {
+	opts Options
+}
+
+// NewFinder returns a new Finder.
+func NewFinder(opts Options) *Finder {
+	if opts.Jobs <= 0 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	if opts.Log == nil {
+		opts.Log = nopLogger{}
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = DCT{}
+	}
+	return &Finder{opts: opts}
+}
+
+type request struct {
+	root      string
+	reference bool
+	path      string
+	size      int64
+	modTime   int64
+	inode     uint64
+	dev       uint64
+	checksum  string
+}
+
+// Scan fingerprints the images under roots. If DB is set, the fingerprints
+// are stored in it.
+func (f *Finder) Scan(ctx context.Context, roots []string) ([]File, error) {
+	m, err := f.scan(ctx, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	for _, fs := range m {
+		files = append(files, fs...)
+	}
+	sortFiles(files)
+
+	return files, nil
+}
+
+// Find fingerprints the images under roots and returns the groups of
+// duplicates, ordered by their fingerprints.
+func (f *Finder) Find(ctx context.Context, roots []string) ([]Group, error) {
+	m, err := f.scan(ctx, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	// Produce repeatable output.
+	hashes := make([]uint64, 0, len(m))
+	for h, files := range m {
+		hashes = append(hashes, h)
+		sortFiles(files)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	if f.opts.NewOnly && f.opts.DB != nil {
+		if err := f.addFromDB(ctx, m, hashes); err != nil {
+			if err == context.Canceled {
+				return nil, err
+			}
+			f.opts.Log.Errorf("Error: cannot get all fingerprints: %v", err)
+		}
+	}
+
+	groups := group(m, hashes, f.opts.Threshold, f.opts.Cluster)
+	if len(f.opts.References) > 0 {
+		groups = ReferencedGroups(groups)
+	}
+	return groups, nil
+}
+
+// addFromDB finds duplicates of the scanned files in the fingerprint database.
+func (f *Finder) addFromDB(ctx context.Context, m map[uint64][]File, hashes []uint64) error {
+	entries, err := f.opts.DB.GetAll(ctx, f.opts.Hasher.Name())
+	if err != nil {
+		return err
+	}
+
+	// Also look for the fingerprints of the transformed images.
+	var variants []uint64
+	var owners []int
+	for i, h := range hashes {
+		for _, v := range m[h][0].Variants {
+			variants = append(variants, v.FP)
+			owners = append(owners, i)
+		}
+	}
+
+	idx := newIndex(hashes)
+	vidx := newIndex(variants)
+	// Only the files added to a group are looked at.
+	dbFile := func(e Entry) File {
+		file := File{Path: e.Path, FP: e.FP}
+		if fi, err := os.Stat(e.Path); err == nil {
+			file.Size = fi.Size()
+			file.ModTime = fi.ModTime()
+		}
+		return f.withVariants(file)
+	}
+	for _, e := range entries {
+		h0 := e.FP
+		if _, ok := m[h0]; ok {
+			m[h0] = appendUniq(m[h0], dbFile(e))
+		} else {
+			// Add to the group of the smallest similar hash.
+			best := -1
+			idx.search(h0, f.opts.Threshold, func(i, _ int) {
+				if best < 0 || i < best {
+					best = i
+				}
+			})
+			vidx.search(h0, f.opts.Threshold, func(i, _ int) {
+				if best < 0 || owners[i] < best {
+					best = owners[i]
+				}
+			})
+			if best >= 0 {
+				h := hashes[best]
+				m[h] = append(m[h], dbFile(e))
+			}
+		}
+	}
+
+	return nil
+}
+
+// withVariants returns file with the fingerprints of its transformed image.
+func (f *Finder) withVariants(file File) File {
+	if len(f.opts.Transforms) == 0 {
+		return file
+	}
+	img, err := f.decode(file.Path)
+	if err != nil {
+		f.opts.Log.Warnf("WARNING: %s: %v", file.Path, err)
+		return file
+	}
+	if file.Variants, err = hashVariants(f.opts.Hasher, img, f.opts.Transforms); err != nil {
+		f.opts.Log.Warnf("WARNING: %s: %v", file.Path, err)
+	}
+	return file
+}
+
+func (f *Finder) scan(ctx context.Context, roots []string) (map[uint64][]File, error) {
+	// libmagic is not safe for concurrent use: every worker has its own
+	// decoder, which it closes.
+	decoders := make([]*magicmime.Decoder, f.opts.Jobs)
+	for i := range decoders {
+		mm, err := magicmime.NewDecoder(magicmime.MAGIC_MIME_TYPE | magicmime.MAGIC_SYMLINK | magicmime.MAGIC_ERROR)
+		if err != nil {
+			for _, mm := range decoders[:i] {
+				mm.Close()
+			}
+			return nil, err
+		}
+		decoders[i] = mm
+	}
+
+	var reqs []request
+	for _, root := range f.opts.References {
+		if err := filepath.Walk(root, f.walkFunc(ctx, root, true, &reqs)); err != nil && ctx.Err() == nil {
+			f.opts.Log.Errorf("%v", err)
+		}
+	}
+	nrefs := len(reqs)
+	for _, root := range roots {
+		if err := filepath.Walk(root, f.walkFunc(ctx, root, false, &reqs)); err != nil && ctx.Err() == nil {
+			f.opts.Log.Errorf("%v", err)
+		}
+	}
+	if nrefs > 0 {
+		reqs = withoutReferences(reqs, nrefs)
+	}
+
+	// Byte-identical files are only fingerprinted once.
+	reqs, copies := f.exactDupes(ctx, reqs)
+
+	m := make(map[uint64][]File)
+
+	results := make(chan File)
+
+	workC := make(chan request)
+	workDone := make(chan chan struct{}, f.opts.Jobs)
+	for _, mm := range decoders {
+		done := make(chan struct{})
+		go f.worker(ctx, mm, workC, copies, results, done)
+		workDone <- done
+	}
+	close(workDone)
+
+	resultDone := make(chan struct{})
+	go resultWorker(m, results, resultDone)
+
+loop:
+	for _, r := range reqs {
+		if f.opts.Progress != nil {
+			f.opts.Progress(r.path)
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case workC <- r:
+		}
+	}
+
+	close(workC)
+	for done := range workDone {
+		<-done
+	}
+	close(results)
+	<-resultDone
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func resultWorker(m map[uint64][]File, in <-chan File, done chan struct{}) {
+	for r := range in {
+		m[r.FP] = append(m[r.FP], r)
+	}
+
+	close(done)
+}
+
+func (f *Finder) worker(ctx context.Context, mm *magicmime.Decoder, in <-chan request, copies map[string][]request, out chan<- File, done chan struct{}) {
+	defer close(done)
+	defer mm.Close()
+
+	db := f.opts.DB
+	log := f.opts.Log
+	hasher := f.opts.Hasher
+	algo := hasher.Name()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m, open := <-in:
+			if !open {
+				return
+			}
+
+			var abspath string
+			var e Entry
+			haveFP := false
+
+			if db != nil {
+				abspath, _ = filepath.Abs(m.path)
+				var ok bool
+				var err error
+				e, ok, err = db.Get(ctx, abspath, algo, m.modTime)
+				if err == nil && !ok {
+					e, ok, err = f.moved(ctx, abspath, m)
+				}
+				switch {
+				case err == context.Canceled:
+					return
+				case err != nil:
+					log.Errorf("ERROR: %v", err)
+				}
+				// Orientation 1 is upright either way; 0 means the
+				// orientation was not looked at.
+				stale := false
+				if f.opts.IgnoreOrientation {
+					haveFP = ok && e.Orientation <= 1
+				} else {
+					haveFP = ok && e.Orientation >= 1
+					if ok && e.Orientation == 0 && exifOrientation(m.path) == 1 {
+						// Fingerprinted by an older version,
+						// but it need not be turned.
+						e.Orientation = 1
+						haveFP, stale = true, true
+					}
+				}
+
+				// Identify the files fingerprinted by older versions.
+				if haveFP && !f.opts.NewOnly && (stale || e.Inode != m.inode || e.Dev != m.dev || e.Partial == "") {
+					e.Inode, e.Dev = m.inode, m.dev
+					if e.Partial == "" {
+						e.Partial, _ = partialChecksum(m.path, m.size)
+					}
+					if err := db.Upsert(ctx, e); err != nil && err != context.Canceled {
+						log.Errorf("ERROR: %v", err)
+					}
+				}
+			}
+
+			if !haveFP {
+				mimetype, err := mm.TypeByFile(m.path)
+				if err != nil {
+					log.Warnf("WARNING: %s: %v", m.path, err)
+					continue
+				}
+
+				if !strings.HasPrefix(mimetype, "image/") {
+					continue
+				}
+
+				fp, orientation, err := fingerprint(hasher, m.path, !f.opts.IgnoreOrientation)
+				if err != nil {
+					log.Warnf("WARNING: %s: %v", m.path, err)
+					continue
+				}
+				e = Entry{
+					Path:        abspath,
+					Algo:        algo,
+					FP:          fp,
+					Lastmod:     m.modTime,
+					Size:        m.size,
+					Orientation: orientation,
+					Checksum:    m.checksum,
+					Inode:       m.inode,
+					Dev:         m.dev,
+				}
+
+				if db != nil && !f.opts.NewOnly {
+					e.Partial, _ = partialChecksum(m.path, m.size)
+					err := db.Upsert(ctx, e)
+					switch {
+					case err == context.Canceled:
+						return
+					case err != nil:
+						log.Errorf("ERROR: %v", err)
+					}
+				}
+			}
+
+			var variants []Variant
+			if len(f.opts.Transforms) > 0 {
+				var ok bool
+				variants, ok = f.variants(ctx, abspath, m, haveFP)
+				if !ok {
+					continue
+				}
+			}
+
+			for _, r := range append([]request{m}, copies[m.checksum]...) {
+				if r.path != m.path && db != nil && !f.opts.NewOnly {
+					f.storeCopy(ctx, r, e)
+				}
+
+				res := File{
+					Path:      r.path,
+					FP:        e.FP,
+					Size:      r.size,
+					ModTime:   time.Unix(0, r.modTime),
+					Root:      r.root,
+					Variants:  variants,
+					Checksum:  r.checksum,
+					Reference: r.reference,
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- res:
+				}
+			}
+		}
+	}
+}
+
+// storeCopy stores the entry e of a fingerprinted file for its byte-identical
+// copy r, unless it is there already.
+func (f *Finder) storeCopy(ctx context.Context, r request, e Entry) {
+	db := f.opts.DB
+	abspath, _ := filepath.Abs(r.path)
+	e.Path, e.Lastmod, e.Checksum = abspath, r.modTime, r.checksum
+	e.Inode, e.Dev = r.inode, r.dev
+	if stored, ok, err := db.Get(ctx, abspath, e.Algo, r.modTime); err == nil && ok && stored == e {
+		return
+	}
+	if err := db.Upsert(ctx, e); err != nil && err != context.Canceled {
+		f.opts.Log.Errorf("ERROR: %v", err)
+	}
+}
+
+// variants returns the fingerprints of the transformed image, from the
+// fingerprint database if they are there and cached is set. The files which
+// cannot be decoded have none; false is only returned on cancellation.
+func (f *Finder) variants(ctx context.Context, abspath string, m request, cached bool) ([]Variant, bool) {
+	db := f.opts.DB
+	algo := f.opts.Hasher.Name()
+
+	if db != nil && cached {
+		stored, err := db.GetVariants(ctx, abspath, algo, m.modTime)
+		if err != nil {
+			if err == context.Canceled {
+				return nil, false
+			}
+			f.opts.Log.Errorf("ERROR: %v", err)
+		}
+		if variants, ok := selectVariants(stored, f.opts.Transforms); ok {
+			return variants, true
+		}
+	}
+
+	img, err := f.decode(m.path)
+	if err != nil {
+		f.opts.Log.Warnf("WARNING: %s: %v", m.path, err)
+		return nil, true
+	}
+	variants, err := hashVariants(f.opts.Hasher, img, f.opts.Transforms)
+	if err != nil {
+		f.opts.Log.Warnf("WARNING: %s: %v", m.path, err)
+		return nil, true
+	}
+
+	if db != nil && !f.opts.NewOnly {
+		err := db.UpsertVariants(ctx, abspath, algo, m.modTime, variants)
+		if err != nil && err != context.Canceled {
+			f.opts.Log.Errorf("ERROR: %v", err)
+		}
+	}
+
+	return variants, true
+}
+
+// decode decodes the image at path and turns it upright, unless
+// IgnoreOrientation is set.
+func (f *Finder) decode(path string) (image.Image, error) {
+	img, err := decode(path)
+	if err != nil || f.opts.IgnoreOrientation {
+		return img, err
+	}
+	return orientationTransforms[exifOrientation(path)].Apply(img), nil
+}
+
+// selectVariants returns the variants for transforms, if all of them are
+// among stored.
+func selectVariants(stored []Variant, transforms []Transform) ([]Variant, bool) {
+	variants := make([]Variant, 0, len(transforms))
+outer:
+	for _, t := range transforms {
+		for _, v := range stored {
+			if v.Transform == t {
+				variants = append(variants, v)
+				continue outer
+			}
+		}
+		return nil, false
+	}
+	return variants, true
+}
+
+func (f *Finder) walkFunc(ctx context.Context, root string, reference bool, reqs *[]request) filepath.WalkFunc {
+	rootDepth := depth(root)
+	return func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if f.opts.Progress != nil {
+			f.opts.Progress(path)
+		}
+
+		if err != nil {
+			f.opts.Log.Warnf("WARNING: %s: %v", path, err)
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			if info.Mode().IsDir() && f.opts.Depth >= 0 && depth(path)-rootDepth >= f.opts.Depth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		for _, excludeRegexp := range f.opts.Excludes {
+			if excludeRegexp.MatchString(path) {
+				return nil
+			}
+		}
+
+		inode, dev := fileID(info)
+		*reqs = append(*reqs, request{
+			root:      root,
+			reference: reference,
+			path:      path,
+			size:      info.Size(),
+			modTime:   info.ModTime().UnixNano(),
+			inode:     inode,
+			dev:       dev,
+		})
+
+		return nil
+	}
+}
+
+// withoutReferences returns reqs without the requests for the files also
+// requested by the first nrefs ones, those for the reference files.
+func withoutReferences(reqs []request, nrefs int) []request {
+	seen := make(map[string]bool, nrefs)
+	for _, r := range reqs[:nrefs] {
+		if abspath, err := filepath.Abs(r.path); err == nil {
+			seen[abspath] = true
+		}
+	}
+	result := reqs[:nrefs]
+	for _, r := range reqs[nrefs:] {
+		if abspath, err := filepath.Abs(r.path); err != nil || !seen[abspath] {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// depth returns the number of path elements in path.
+func depth(path string) int {
+	path = filepath.Clean(path)
+	if path == "." || path == string(filepath.Separator) {
+		return 0
+	}
+	return strings.Count(strings.Trim(path, string(filepath.Separator)), string(filepath.Separator)) + 1
+}
+
+func appendUniq(a []File, f File) []File {
+	for _, v := range a {
+		if v.Path == f.Path {
+			return a
+		}
+	}
+	return append(a, f)
+}
+
+func sortFiles(files []File) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+}
@@ -0,0 +1,397 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"fmt"
+	"sort"
+
+	"gitlab.com/opennota/phash"
+)
+
+// Group is a set of duplicate or similar images.
+type Group struct {
+	// FP is the fingerprint representing the group.
+	FP uint64
+
+	// Files are the images, sorted by path.
+	Files []File
+}
+
+// Paths returns the paths of the files in the group.
+func (g Group) Paths() []string {
+	paths := make([]string, len(g.Files))
+	for i, f := range g.Files {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+// Distance returns the Hamming distance between the fingerprint of f, or
+// of its transformed variant closest to that of the group, and that of the
+// group.
+func (g Group) Distance(f File) int {
+	d, _ := distance(f, g.FP)
+	return d
+}
+
+// Transform returns the transform of f whose fingerprint is the closest to
+// that of the group.
+func (g Group) Transform(f File) Transform {
+	_, t := distance(f, g.FP)
+	return t
+}
+
+// Exact reports whether f is a byte-identical copy of another file in the
+// group.
+func (g Group) Exact(f File) bool {
+	if f.Checksum == "" {
+		return false
+	}
+	for _, o := range g.Files {
+		if o.Path != f.Path && o.Checksum == f.Checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxDistance returns the largest Hamming distance between the fingerprints
+// of any two files in the group.
+func (g Group) MaxDistance() int {
+	max := 0
+	for i := 0; i < len(g.Files)-1; i++ {
+		for j := i + 1; j < len(g.Files); j++ {
+			if d, _ := distance(g.Files[i], g.Files[j].FP); d > max {
+				max = d
+			}
+		}
+	}
+	return max
+}
+
+// SplitDistinct splits the groups so that no two files which distinct
+// reports are not duplicates of each other are in the same group. Every
+// file goes to the first part of its group with none of those, in order;
+// the parts of a single file are dropped.
+func SplitDistinct(groups []Group, distinct func(a, b File) bool) []Group {
+	var result []Group
+	for _, g := range groups {
+		var parts []Group
+	files:
+		for _, f := range g.Files {
+		parts:
+			for i, p := range parts {
+				for _, o := range p.Files {
+					if distinct(f, o) {
+						continue parts
+					}
+				}
+				parts[i].Files = append(parts[i].Files, f)
+				continue files
+			}
+			parts = append(parts, Group{FP: g.FP, Files: []File{f}})
+		}
+		for _, p := range parts {
+			if len(p.Files) > 1 {
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// ReferencedGroups returns the groups with both reference files and other
+// files.
+func ReferencedGroups(groups []Group) []Group {
+	var result []Group
+	for _, g := range groups {
+		refs := 0
+		for _, f := range g.Files {
+			if f.Reference {
+				refs++
+			}
+		}
+		if refs > 0 && refs < len(g.Files) {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// distance returns the smallest Hamming distance between fp and the
+// fingerprints of f and its variants, and the transform it is achieved by.
+func distance(f File, fp uint64) (int, Transform) {
+	d, t := phash.HammingDistance(f.FP, fp), Identity
+	for _, v := range f.Variants {
+		if dv := phash.HammingDistance(v.FP, fp); dv < d {
+			d, t = dv, v.Transform
+		}
+	}
+	return d, t
+}
+
+// Cluster is a method of grouping similar images.
+type Cluster int
+
+const (
+	// SingleLinkage groups the images linked by a chain of similar
+	// images, however far apart the ends of the chain are.
+	SingleLinkage Cluster = iota
+
+	// CompleteLinkage only groups images which are all similar to each
+	// other.
+	CompleteLinkage
+
+	// Star groups the images similar to a central image.
+	Star
+)
+
+// Clusters lists the names accepted by ParseCluster.
+var Clusters = []string{"single", "complete", "star"}
+
+// ParseCluster returns the clustering method with the given name.
+func ParseCluster(name string) (Cluster, error) {
+	for i, n := range Clusters {
+		if n == name {
+			return Cluster(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown clustering method: %s", name)
+}
+
+// group merges the files whose fingerprints are within threshold of each
+// other and returns the groups of two or more files, ordered by the
+// fingerprints representing them. hashes are the keys of m, sorted.
+func group(m map[uint64][]File, hashes []uint64, threshold int, cluster Cluster) []Group {
+	// Find similar hashes.
+	if threshold > 0 || hasVariants(m) {
+		g := newGraph(m, hashes, threshold)
+		var rep []int
+		switch cluster {
+		case CompleteLinkage:
+			rep = completeLinkage(g)
+		case Star:
+			rep = star(g)
+		default:
+			rep = singleLinkage(g)
+		}
+
+		for i, h := range hashes {
+			if p := rep[i]; p != i {
+				hp := hashes[p]
+				m[hp] = append(m[hp], m[h]...)
+				delete(m, h)
+			}
+		}
+	}
+
+	var groups []Group
+	for _, h := range hashes {
+		files := m[h]
+		if len(files) < 2 {
+			continue
+		}
+
+		sortFiles(files)
+		groups = append(groups, Group{FP: h, Files: files})
+	}
+
+	return groups
+}
+
+func hasVariants(m map[uint64][]File) bool {
+	for _, files := range m {
+		if len(files[0].Variants) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// graph links the similar hashes.
+type graph struct {
+	hashes    []uint64
+	variants  [][]Variant
+	threshold int
+	idx       *index
+}
+
+func newGraph(m map[uint64][]File, hashes []uint64, threshold int) *graph {
+	g := &graph{
+		hashes:    hashes,
+		variants:  make([][]Variant, len(hashes)),
+		threshold: threshold,
+		idx:       newIndex(hashes),
+	}
+	for i, h := range hashes {
+		for _, f := range m[h] {
+			if len(f.Variants) > 0 {
+				g.variants[i] = f.Variants
+				break
+			}
+		}
+	}
+	return g
+}
+
+// search calls fn with the index of every hash within threshold of hash i,
+// or of its variants; the same index may be passed more than once.
+func (g *graph) search(i int, fn func(j, dist int)) {
+	g.idx.search(g.hashes[i], g.threshold, fn)
+	for _, v := range g.variants[i] {
+		g.idx.search(v.FP, g.threshold, fn)
+	}
+}
+
+// distance returns the distance between the hashes i and j.
+func (g *graph) distance(i, j int) int {
+	d := phash.HammingDistance(g.hashes[i], g.hashes[j])
+	for _, v := range g.variants[i] {
+		if dv := phash.HammingDistance(v.FP, g.hashes[j]); dv < d {
+			d = dv
+		}
+	}
+	return d
+}
+
+// singleLinkage returns the index of the hash representing the group of
+// every hash; it is the smallest hash of the group.
+func singleLinkage(g *graph) []int {
+	// Use union-find to group hashes, looking for the similar ones in an
+	// index.
+	parent := make([]int, len(g.hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if i != parent[i] {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range g.hashes {
+		g.search(i, func(j, _ int) {
+			p1, p2 := find(i), find(j)
+			if p1 == p2 {
+				return
+			}
+			if p2 < p1 {
+				p1, p2 = p2, p1
+			}
+			parent[p2] = p1
+		})
+	}
+
+	for i := range parent {
+		find(i)
+	}
+	return parent
+}
+
+type neighbour struct {
+	index int
+	dist  int
+}
+
+// neighbours returns the hashes similar to every hash, closest first.
+func neighbours(g *graph) [][]neighbour {
+	adj := make([][]neighbour, len(g.hashes))
+	dist := make(map[int]int)
+	for i := range g.hashes {
+		g.search(i, func(j, d int) {
+			if j == i {
+				return
+			}
+			if d0, ok := dist[j]; !ok || d < d0 {
+				dist[j] = d
+			}
+		})
+		for j, d := range dist {
+			adj[i] = append(adj[i], neighbour{j, d})
+			delete(dist, j)
+		}
+		sort.Slice(adj[i], func(a, b int) bool {
+			na, nb := adj[i][a], adj[i][b]
+			if na.dist != nb.dist {
+				return na.dist < nb.dist
+			}
+			return na.index < nb.index
+		})
+	}
+	return adj
+}
+
+// completeLinkage greedily builds groups in which every hash is within
+// threshold of every other one. Each group is represented by the hash it
+// was started from.
+func completeLinkage(g *graph) []int {
+	adj := neighbours(g)
+	rep := make([]int, len(g.hashes))
+	for i := range rep {
+		rep[i] = -1
+	}
+
+	for i := range g.hashes {
+		if rep[i] >= 0 {
+			continue
+		}
+		rep[i] = i
+		members := []int{i}
+	candidates:
+		for _, n := range adj[i] {
+			if rep[n.index] >= 0 {
+				continue
+			}
+			for _, k := range members[1:] {
+				if g.distance(n.index, k) > g.threshold {
+					continue candidates
+				}
+			}
+			rep[n.index] = i
+			members = append(members, n.index)
+		}
+	}
+
+	return rep
+}
+
+// star groups the hashes around the hashes with the most neighbours, which
+// represent the groups.
+func star(g *graph) []int {
+	adj := neighbours(g)
+	order := make([]int, len(g.hashes))
+	rep := make([]int, len(g.hashes))
+	for i := range order {
+		order[i] = i
+		rep[i] = -1
+	}
+	sort.SliceStable(order, func(a, b int) bool { return len(adj[order[a]]) > len(adj[order[b]]) })
+
+	for _, i := range order {
+		if rep[i] >= 0 {
+			continue
+		}
+		rep[i] = i
+		for _, n := range adj[i] {
+			if rep[n.index] < 0 {
+				rep[n.index] = i
+			}
+		}
+	}
+
+	return rep
+}
@@ -0,0 +1,202 @@
+package dupes
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGroup(t *testing.T) {
+	m := map[uint64][]File{
+		0x00: {{Path: "b"}, {Path: "a"}},
+		0x01: {{Path: "c", FP: 0x01}},
+		0x03: {{Path: "d", FP: 0x03}},
+		0xf0: {{Path: "e", FP: 0xf0}},
+	}
+	hashes := []uint64{0x00, 0x01, 0x03, 0xf0}
+
+	groups := group(m, hashes, 1, SingleLinkage)
+	if len(groups) != 1 {
+		t.Fatalf("want 1 group, got %d", len(groups))
+	}
+	g := groups[0]
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(g.Paths(), want) {
+		t.Errorf("want %v, got %v", want, g.Paths())
+	}
+	if d := g.MaxDistance(); d != 2 {
+		t.Errorf("MaxDistance: want 2, got %d", d)
+	}
+}
+
+// groupNaive is the reference implementation of group, which compares every
+// pair of hashes.
+func groupNaive(m map[uint64][]File, hashes []uint64, threshold int, _ Cluster) []Group {
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if i != parent[i] {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := 0; i < len(hashes)-1; i++ {
+		for j := i + 1; j < len(hashes); j++ {
+			if bits.OnesCount64(hashes[i]^hashes[j]) > threshold {
+				continue
+			}
+
+			p1, p2 := find(i), find(j)
+			if p1 == p2 {
+				continue
+			}
+
+			parent[p2] = p1
+			h1p, h2p := hashes[p1], hashes[p2]
+			m[h1p] = append(m[h1p], m[h2p]...)
+			delete(m, h2p)
+		}
+	}
+
+	var groups []Group
+	for _, h := range hashes {
+		if files := m[h]; len(files) > 1 {
+			sortFiles(files)
+			groups = append(groups, Group{FP: h, Files: files})
+		}
+	}
+	return groups
+}
+
+// randomHashes returns n hashes clustered around n/10 random centers.
+func randomHashes(n int) (map[uint64][]File, []uint64) {
+	rnd := rand.New(rand.NewSource(1))
+	centers := make([]uint64, n/10+1)
+	for i := range centers {
+		centers[i] = rnd.Uint64()
+	}
+
+	m := make(map[uint64][]File)
+	for i := 0; i < n; i++ {
+		h := centers[rnd.Intn(len(centers))]
+		for k := rnd.Intn(8); k > 0; k-- {
+			h ^= 1 << uint(rnd.Intn(64))
+		}
+		m[h] = append(m[h], File{Path: fmt.Sprint(i), FP: h})
+	}
+
+	hashes := make([]uint64, 0, len(m))
+	for h := range m {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	return m, hashes
+}
+
+func copyMap(m map[uint64][]File) map[uint64][]File {
+	c := make(map[uint64][]File, len(m))
+	for h, files := range m {
+		c[h] = append([]File(nil), files...)
+	}
+	return c
+}
+
+func groupSets(groups []Group) []string {
+	var sets []string
+	for _, g := range groups {
+		sets = append(sets, strings.Join(g.Paths(), " "))
+	}
+	sort.Strings(sets)
+	return sets
+}
+
+func TestGroupMatchesNaive(t *testing.T) {
+	m, hashes := randomHashes(2000)
+	// From 16 on, the index compares with every hash.
+	for _, threshold := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 15, 16, 20, 24} {
+		want := groupSets(groupNaive(copyMap(m), hashes, threshold, SingleLinkage))
+		got := groupSets(group(copyMap(m), hashes, threshold, SingleLinkage))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("threshold %d: the groups differ from those of the naive implementation", threshold)
+		}
+	}
+}
+
+func benchmarkGroup(b *testing.B, fn func(map[uint64][]File, []uint64, int, Cluster) []Group) {
+	m, hashes := randomHashes(20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := copyMap(m)
+		b.StartTimer()
+		fn(c, hashes, 6, SingleLinkage)
+	}
+}
+
+func BenchmarkGroup(b *testing.B)      { benchmarkGroup(b, group) }
+func BenchmarkGroupNaive(b *testing.B) { benchmarkGroup(b, groupNaive) }
+
+func TestGroupClusters(t *testing.T) {
+	const threshold = 6
+	m, hashes := randomHashes(2000)
+	for _, cluster := range []Cluster{CompleteLinkage, Star} {
+		groups := group(copyMap(m), hashes, threshold, cluster)
+		n := 0
+		for _, g := range groups {
+			n += len(g.Files)
+			if cluster == CompleteLinkage {
+				if d := g.MaxDistance(); d > threshold {
+					t.Errorf("%s: distance %d within a group", Clusters[cluster], d)
+				}
+				continue
+			}
+			for _, f := range g.Files {
+				if d := g.Distance(f); d > threshold {
+					t.Errorf("%s: distance %d to the center", Clusters[cluster], d)
+				}
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: no groups", Clusters[cluster])
+		}
+	}
+}
+
+func TestSplitDistinct(t *testing.T) {
+	groups := []Group{
+		{Files: []File{{Path: "a"}, {Path: "b"}, {Path: "c"}, {Path: "d"}}},
+		{Files: []File{{Path: "e"}, {Path: "f"}}},
+	}
+	marked := map[string]bool{"a b": true, "c d": true, "a d": true, "e f": true}
+	distinct := func(a, b File) bool {
+		return marked[a.Path+" "+b.Path] || marked[b.Path+" "+a.Path]
+	}
+
+	var got [][]string
+	for _, g := range SplitDistinct(groups, distinct) {
+		got = append(got, g.Paths())
+	}
+	if want := [][]string{{"a", "c"}, {"b", "d"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestReferencedGroups(t *testing.T) {
+	groups := []Group{
+		{Files: []File{{Path: "a", Reference: true}, {Path: "b"}}},
+		{Files: []File{{Path: "c"}, {Path: "d"}}},
+		{Files: []File{{Path: "e", Reference: true}, {Path: "f", Reference: true}}},
+	}
+	got := ReferencedGroups(groups)
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Paths(), []string{"a", "b"}) {
+		t.Errorf("want the group of a and b only, got %v", got)
+	}
+}
@@ -0,0 +1,293 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gitlab.com/opennota/phash"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+)
+
+// Hasher computes 64-bit perceptual hashes of images.
+type Hasher interface {
+	// Name returns the name of the algorithm, which is stored along
+	// with the hashes in the fingerprint database.
+	Name() string
+
+	// Hash returns the hash of img.
+	Hash(img image.Image) (uint64, error)
+}
+
+// FileHasher is implemented by the Hashers which hash image files without
+// decoding them with the image package.
+type FileHasher interface {
+	HashFile(path string) (uint64, error)
+}
+
+// Hashers lists the available hash algorithms, the default one first.
+var Hashers = []Hasher{
+	DCT{},
+	AHash{},
+	DHash{},
+	WHash{},
+	BlockMean{},
+}
+
+// HasherByName returns the hash algorithm with the given name.
+func HasherByName(name string) (Hasher, error) {
+	for _, h := range Hashers {
+		if h.Name() == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hash algorithm: %s", name)
+}
+
+// HashFile returns the hash of the image at path.
+func HashFile(h Hasher, path string) (uint64, error) {
+	if fh, ok := h.(FileHasher); ok {
+		return fh.HashFile(path)
+	}
+
+	img, err := decode(path)
+	if err != nil {
+		return 0, err
+	}
+	return h.Hash(img)
+}
+
+// fingerprint returns the hash of the image at path. If exif is set, the
+// image is turned upright according to its EXIF orientation, which is
+// returned, before it is hashed.
+func fingerprint(h Hasher, path string, exif bool) (uint64, int, error) {
+	if !exif {
+		fp, err := HashFile(h, path)
+		return fp, 0, err
+	}
+
+	o := exifOrientation(path)
+	if o == 1 {
+		fp, err := HashFile(h, path)
+		return fp, o, err
+	}
+
+	// Hashed like the files which need not be turned, so that their
+	// fingerprints are comparable.
+	img, err := decode(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	fp, err := h.Hash(orientationTransforms[o].Apply(img))
+	return fp, o, err
+}
+
+func decode(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(bufio.NewReader(f))
+	return img, err
+}
+
+// DCT is the pHash algorithm, based on the discrete cosine transform. The
+// images are hashed by the pHash library; the decoded ones through a
+// temporary BMP copy, so that their hashes are comparable with those of the
+// files.
+type DCT struct{}
+
+func (DCT) Name() string { return "dct" }
+
+func (DCT) HashFile(path string) (uint64, error) { return phash.ImageHashDCT(path) }
+
+func (DCT) Hash(img image.Image) (uint64, error) {
+	f, err := ioutil.TempFile("", "findimagedupes-*.bmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = bmp.Encode(w, img)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return phash.ImageHashDCT(f.Name())
+}
+
+// AHash is the average hash: the bits are set for the pixels of the 8x8
+// thumbnail brighter than its mean.
+type AHash struct{}
+
+func (AHash) Name() string { return "ahash" }
+
+func (AHash) Hash(img image.Image) (uint64, error) {
+	px := gray(img, 8, 8)
+	mean := 0.0
+	for _, p := range px {
+		mean += p
+	}
+	mean /= float64(len(px))
+
+	var h uint64
+	for i, p := range px {
+		if p > mean {
+			h |= 1 << uint(i)
+		}
+	}
+	return h, nil
+}
+
+// DHash is the difference hash: the bits are set for the pixels of the 9x8
+// thumbnail brighter than their right neighbours.
+type DHash struct{}
+
+func (DHash) Name() string { return "dhash" }
+
+func (DHash) Hash(img image.Image) (uint64, error) {
+	px := gray(img, 9, 8)
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if px[y*9+x] > px[y*9+x+1] {
+				h |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return h, nil
+}
+
+// WHash is the wavelet hash: the bits are set for the coefficients of the
+// approximation of the 64x64 thumbnail by a three-level Haar wavelet
+// transform above their median.
+type WHash struct{}
+
+func (WHash) Name() string { return "whash" }
+
+func (WHash) Hash(img image.Image) (uint64, error) {
+	const size = 64
+	px := gray(img, size, size)
+
+	tmp := make([]float64, size)
+	for n := size; n > 8; n /= 2 {
+		// Transform the rows, then the columns, of the top-left n x n
+		// block, keeping the averages in its top-left quarter.
+		for y := 0; y < n; y++ {
+			for x := 0; x < n/2; x++ {
+				a, b := px[y*size+2*x], px[y*size+2*x+1]
+				tmp[x], tmp[n/2+x] = (a+b)/2, (a-b)/2
+			}
+			copy(px[y*size:y*size+n], tmp[:n])
+		}
+		for x := 0; x < n; x++ {
+			for y := 0; y < n/2; y++ {
+				a, b := px[2*y*size+x], px[(2*y+1)*size+x]
+				tmp[y], tmp[n/2+y] = (a+b)/2, (a-b)/2
+			}
+			for y := 0; y < n; y++ {
+				px[y*size+x] = tmp[y]
+			}
+		}
+	}
+
+	var ll [64]float64
+	for y := 0; y < 8; y++ {
+		copy(ll[y*8:y*8+8], px[y*size:y*size+8])
+	}
+	return aboveMedian(ll[:]), nil
+}
+
+// BlockMean is the block mean value hash: the 64x64 thumbnail is divided
+// into 8x8 blocks, and the bits are set for the blocks brighter than the
+// median of their horizontal band of 16 blocks.
+type BlockMean struct{}
+
+func (BlockMean) Name() string { return "blockmean" }
+
+func (BlockMean) Hash(img image.Image) (uint64, error) {
+	const size = 64
+	px := gray(img, size, size)
+
+	var blocks [64]float64
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			blocks[y/8*8+x/8] += px[y*size+x]
+		}
+	}
+
+	var h uint64
+	for band := 0; band < 4; band++ {
+		b := blocks[band*16 : band*16+16]
+		m := median(b)
+		for i, v := range b {
+			if v > m {
+				h |= 1 << uint(band*16+i)
+			}
+		}
+	}
+	return h, nil
+}
+
+// gray returns the luminance of the pixels of img scaled to w x h.
+func gray(img image.Image, w, h int) []float64 {
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	px := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px[y*w+x] = float64(dst.Pix[y*dst.Stride+x])
+		}
+	}
+	return px
+}
+
+func median(v []float64) float64 {
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 0 {
+		return (s[n/2-1] + s[n/2]) / 2
+	}
+	return s[n/2]
+}
+
+// aboveMedian returns a hash with the bits set for the values of v (at most
+// 64 of them) above their median.
+func aboveMedian(v []float64) uint64 {
+	m := median(v)
+	var h uint64
+	for i, c := range v {
+		if c > m {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
@@ -0,0 +1,52 @@
+package dupes
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+)
+
+func testImage(w, h int, invert bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*x/w + 3*y) * 255 / (w + 3*h))
+			if (x*8/w+y*4/h)%3 == 0 {
+				v /= 2
+			}
+			if invert {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func TestHashers(t *testing.T) {
+	img := testImage(320, 240, false)
+	scaled := testImage(640, 480, false)
+	inverted := testImage(320, 240, true)
+
+	for _, h := range Hashers {
+		hash := func(img image.Image) uint64 {
+			fp, err := h.Hash(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fp
+		}
+		h0 := hash(img)
+		if d := bits.OnesCount64(h0 ^ hash(scaled)); d > 8 {
+			t.Errorf("%s: distance to the scaled image is %d", h.Name(), d)
+		}
+		if d := bits.OnesCount64(h0 ^ hash(inverted)); d < 16 {
+			t.Errorf("%s: distance to the inverted image is %d", h.Name(), d)
+		}
+
+		if got, err := HasherByName(h.Name()); err != nil || got != h {
+			t.Errorf("HasherByName(%q) = %v, %v", h.Name(), got, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"math/bits"
+
+	"gitlab.com/opennota/phash"
+)
+
+const (
+	chunks    = 4
+	chunkBits = 64 / chunks
+)
+
+// index finds the fingerprints within a given Hamming distance of a
+// fingerprint using multi-index hashing: the fingerprints are split into
+// chunks, and two fingerprints within distance t of each other have at least
+// one chunk within distance t/chunks, so only the fingerprints sharing such
+// a chunk need to be compared.
+type index struct {
+	hashes []uint64
+
+	// The indices of the hashes whose chunk c equals k are
+	// tables[c].items[tables[c].start[k]:tables[c].start[k+1]].
+	tables [chunks]struct {
+		start []int32
+		items []int32
+	}
+
+	// Scratch space for search.
+	seen  []uint32
+	epoch uint32
+}
+
+func newIndex(hashes []uint64) *index {
+	idx := &index{
+		hashes: hashes,
+		seen:   make([]uint32, len(hashes)),
+	}
+	for c := range idx.tables {
+		t := &idx.tables[c]
+		t.start = make([]int32, 1<<chunkBits+1)
+		for _, h := range hashes {
+			t.start[int(chunk(h, c))+1]++
+		}
+		for k := 1; k < len(t.start); k++ {
+			t.start[k] += t.start[k-1]
+		}
+		t.items = make([]int32, len(hashes))
+		next := append([]int32(nil), t.start[:1<<chunkBits]...)
+		for i, h := range hashes {
+			k := chunk(h, c)
+			t.items[next[k]] = int32(i)
+			next[k]++
+		}
+	}
+	return idx
+}
+
+func chunk(h uint64, c int) uint16 {
+	return uint16(h >> (uint(c) * chunkBits))
+}
+
+// search calls fn with the index and the distance of every hash within
+// threshold of hash. It is not safe for concurrent use.
+func (idx *index) search(hash uint64, threshold int, fn func(i, dist int)) {
+	r := threshold / chunks
+	if r >= 4 {
+		// Enumerating the neighbouring chunks costs more than comparing
+		// with every hash.
+		for i, h := range idx.hashes {
+			if d := phash.HammingDistance(hash, h); d <= threshold {
+				fn(i, d)
+			}
+		}
+		return
+	}
+
+	idx.epoch++
+	if idx.epoch == 0 {
+		for i := range idx.seen {
+			idx.seen[i] = 0
+		}
+		idx.epoch = 1
+	}
+
+	masks := chunkMasks[r]
+	for c := range idx.tables {
+		t := &idx.tables[c]
+		k := chunk(hash, c)
+		for _, mask := range masks {
+			km := k ^ mask
+			for _, i := range t.items[t.start[km]:t.start[int(km)+1]] {
+				if idx.seen[i] == idx.epoch {
+					continue
+				}
+				idx.seen[i] = idx.epoch
+				if d := phash.HammingDistance(hash, idx.hashes[i]); d <= threshold {
+					fn(int(i), d)
+				}
+			}
+		}
+	}
+}
+
+// chunkMasks[r] are all the chunk values with at most r bits set.
+var chunkMasks [4][]uint16
+
+func init() {
+	for v := 0; v < 1<<chunkBits; v++ {
+		n := bits.OnesCount16(uint16(v))
+		for r := n; r < len(chunkMasks); r++ {
+			chunkMasks[r] = append(chunkMasks[r], uint16(v))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif" // Register decoders.
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// KeepPolicy chooses which file of a group is kept when the others are
+// removed. It returns the index of the file to keep.
+type KeepPolicy func(files []File) int
+
+// KeepPolicies lists the names accepted by ParseKeepPolicy.
+var KeepPolicies = []string{
+	"largest",
+	"smallest",
+	"highest-resolution",
+	"oldest",
+	"newest",
+	"shortest-path",
+	"first-root",
+}
+
+// ParseKeepPolicy returns the policy with the given name. roots are the
+// roots passed to Find, in order; they are used by the first-root policy.
+func ParseKeepPolicy(name string, roots []string) (KeepPolicy, error) {
+	switch name {
+	case "largest":
+		return best(func(a, b File) bool { return a.Size > b.Size }), nil
+	case "smallest":
+		return best(func(a, b File) bool { return a.Size < b.Size }), nil
+	case "highest-resolution":
+		return func(files []File) int {
+			res := make(map[string]int, len(files))
+			for _, f := range files {
+				res[f.Path] = resolution(f.Path)
+			}
+			return best(func(a, b File) bool {
+				if res[a.Path] != res[b.Path] {
+					return res[a.Path] > res[b.Path]
+				}
+				return a.Size > b.Size
+			})(files)
+		}, nil
+	case "oldest":
+		return best(func(a, b File) bool { return a.ModTime.Before(b.ModTime) }), nil
+	case "newest":
+		return best(func(a, b File) bool { return a.ModTime.After(b.ModTime) }), nil
+	case "shortest-path":
+		return best(func(a, b File) bool { return len(a.Path) < len(b.Path) }), nil
+	case "first-root":
+		index := make(map[string]int, len(roots))
+		for i := len(roots) - 1; i >= 0; i-- {
+			index[roots[i]] = i
+		}
+		rootIndex := func(f File) int {
+			if i, ok := index[f.Root]; ok {
+				return i
+			}
+			return len(roots)
+		}
+		return best(func(a, b File) bool { return rootIndex(a) < rootIndex(b) }), nil
+	}
+	return nil, fmt.Errorf("unknown keep policy: %s", name)
+}
+
+// best returns a policy choosing the first file that no other file is
+// better than.
+func best(better func(a, b File) bool) KeepPolicy {
+	return func(files []File) int {
+		k := 0
+		for i := 1; i < len(files); i++ {
+			if better(files[i], files[k]) {
+				k = i
+			}
+		}
+		return k
+	}
+}
+
+// resolution returns the number of pixels of the image at path, or 0 if it
+// cannot be determined.
+func resolution(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0
+	}
+	return cfg.Width * cfg.Height
+}
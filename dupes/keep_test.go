@@ -0,0 +1,40 @@
+package dupes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseKeepPolicy(t *testing.T) {
+	now := time.Now()
+	files := []File{
+		{Path: "/b/long/name.jpg", Size: 10, ModTime: now, Root: "/b"},
+		{Path: "/a/x.jpg", Size: 30, ModTime: now.Add(-time.Hour), Root: "/a"},
+		{Path: "/b/y.jpg", Size: 20, ModTime: now.Add(time.Hour), Root: "/b"},
+	}
+	roots := []string{"/b", "/a"}
+
+	for _, tc := range []struct {
+		policy string
+		want   int
+	}{
+		{"largest", 1},
+		{"smallest", 0},
+		{"oldest", 1},
+		{"newest", 2},
+		{"shortest-path", 1},
+		{"first-root", 0},
+	} {
+		keep, err := ParseKeepPolicy(tc.policy, roots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keep(files); got != tc.want {
+			t.Errorf("%s: want %d, got %d", tc.policy, tc.want, got)
+		}
+	}
+
+	if _, err := ParseKeepPolicy("random", roots); err == nil {
+		t.Error("want an error for an unknown policy")
+	}
+}
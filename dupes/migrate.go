@@ -0,0 +1,190 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the schema of the fingerprint database; migrations[i]
+// upgrades it from version i to version i+1. The databases created before
+// the schema was versioned are at version 0, whatever their columns, so the
+// migrations which may find their work done already check for it first.
+//
+// Only ever append to the list.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: the original table.
+	exec("CREATE TABLE IF NOT EXISTS fingerprints (path TEXT PRIMARY KEY, fp INTEGER, lastmod INTEGER)"),
+
+	// 2: some old versions stored the modification times in another
+	// format; make sure those files are fingerprinted again.
+	exec("UPDATE fingerprints SET fp = 0, lastmod = 0 WHERE typeof(lastmod) <> 'integer'"),
+
+	// 3: the hash algorithm, which is part of the primary key, so the
+	// table has to be rebuilt. The old fingerprints are DCT hashes.
+	func(tx *sql.Tx) error {
+		cols, err := columns(tx, "fingerprints")
+		if err != nil || cols["algo"] {
+			return err
+		}
+		return exec(
+			"CREATE TABLE fingerprints_new (path TEXT, algo TEXT, fp INTEGER, lastmod INTEGER, PRIMARY KEY (path, algo))",
+			"INSERT INTO fingerprints_new (path, algo, fp, lastmod) SELECT path, 'dct', fp, lastmod FROM fingerprints",
+			"DROP TABLE fingerprints",
+			"ALTER TABLE fingerprints_new RENAME TO fingerprints",
+		)(tx)
+	},
+
+	// 4: the fingerprints of the rotated and mirrored images.
+	exec("CREATE TABLE IF NOT EXISTS variants (path TEXT, algo TEXT, transform INTEGER, fp INTEGER, lastmod INTEGER, PRIMARY KEY (path, algo, transform))"),
+
+	// 5: the EXIF orientation.
+	addColumn("fingerprints", "orientation", "INTEGER"),
+
+	// 6: the checksums of the files.
+	addColumn("fingerprints", "checksum", "TEXT"),
+
+	// 7: the sizes of the files.
+	addColumn("fingerprints", "size", "INTEGER"),
+
+	// 8: the metadata, such as the library root.
+	exec("CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT)"),
+
+	// 9: what identifies the moved files.
+	exec(
+		"ALTER TABLE fingerprints ADD COLUMN inode INTEGER",
+		"ALTER TABLE fingerprints ADD COLUMN dev INTEGER",
+		"ALTER TABLE fingerprints ADD COLUMN partial TEXT",
+		"CREATE INDEX fingerprints_size ON fingerprints (size, lastmod)",
+	),
+
+	// 10: the pairs of files marked as not duplicates.
+	exec("CREATE TABLE IF NOT EXISTS distinct_pairs (a TEXT, b TEXT, PRIMARY KEY (a, b))"),
+}
+
+// SchemaVersion returns the version of the database schema used by this
+// package.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func exec(queries ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, q := range queries {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func addColumn(table, column, typ string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		cols, err := columns(tx, table)
+		if err != nil || cols[column] {
+			return err
+		}
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + typ)
+		return err
+	}
+}
+
+// columns returns the names of the columns of table.
+func columns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var cid int
+		var name, typ string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// schemaVersion returns the version of the schema of the database.
+func schemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER)"); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// migrate upgrades the schema of the database to the latest version. It
+// returns the versions before and after.
+func migrate(db *sql.DB) (int, int, error) {
+	from, err := schemaVersion(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > len(migrations) {
+		return from, from, fmt.Errorf("the database schema version %d is newer than the supported one (%d); upgrade findimagedupes", from, len(migrations))
+	}
+
+	for v := from; v < len(migrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return from, v, err
+		}
+		if err := migrations[v](tx); err != nil {
+			_ = tx.Rollback()
+			return from, v, fmt.Errorf("migration to schema version %d: %v", v+1, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+			_ = tx.Rollback()
+			return from, v, err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", v+1); err != nil {
+			_ = tx.Rollback()
+			return from, v, err
+		}
+		if err := tx.Commit(); err != nil {
+			return from, v, err
+		}
+	}
+
+	return from, len(migrations), nil
+}
+
+// Migrate upgrades the schema of the fingerprint database at dbpath to the
+// latest version. It returns the versions before and after.
+func Migrate(dbpath string) (int, int, error) {
+	db, err := sql.Open("sqlite3", dbpath)
+	if err != nil {
+		return 0, 0, err
+	}
+	from, to, err := migrate(db)
+	if err != nil {
+		db.Close()
+		return from, to, err
+	}
+	return from, to, db.Close()
+}
@@ -0,0 +1,63 @@
+package dupes
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbpath := filepath.Join(dir, "fp.db")
+
+	// A database of the first versions, with a malformed row.
+	db, err := sql.Open("sqlite3", dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE fingerprints (path TEXT PRIMARY KEY, fp INTEGER, lastmod INTEGER)",
+		"INSERT INTO fingerprints VALUES ('/a.jpg', 42, 1000)",
+		"INSERT INTO fingerprints VALUES ('/b.jpg', 43, '2006-01-02')",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	from, to, err := Migrate(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || to != SchemaVersion() {
+		t.Fatalf("migrated from %d to %d, want 0 to %d", from, to, SchemaVersion())
+	}
+
+	fdb, err := OpenDatabase(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok, err := fdb.Get(context.Background(), "/a.jpg", "dct", 1000)
+	if err != nil || !ok || e.FP != 42 {
+		t.Errorf("got %v, %v, %v; want the old fingerprint", e, ok, err)
+	}
+	if _, ok, _ := fdb.Get(context.Background(), "/b.jpg", "dct", 0); !ok {
+		t.Error("the malformed row is lost")
+	}
+	if _, err := fdb.db.Exec("UPDATE schema_version SET version = version + 1"); err != nil {
+		t.Fatal(err)
+	}
+	fdb.Close()
+
+	if _, err := OpenDatabase(dbpath); err == nil {
+		t.Error("a database of a newer version is opened")
+	}
+}
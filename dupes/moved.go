@@ -0,0 +1,184 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// partialSize is the number of bytes at each end of a file hashed by
+// partialChecksum.
+const partialSize = 64 << 10
+
+// partialChecksum returns a checksum of the size and of the beginning and
+// the end of the file at path, in hex.
+func partialChecksum(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, partialSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	if size > 2*partialSize {
+		if _, err := f.Seek(-partialSize, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(size >> (8 * i))
+	}
+	h.Write(b[:])
+
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// candidates returns the entries computed by the algorithm algo of the files
+// of the given size and modification time, the pending ones included.
+func (db *DB) candidates(ctx context.Context, algo string, size, modtime int64) ([]Entry, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT "+entryColumns+" FROM fingerprints WHERE size = ? AND lastmod = ? AND algo = ?", size, modtime, algo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The pending entries replace the stored ones.
+	db.mu.RLock()
+	stored := entries
+	entries = entries[:0]
+	for _, e := range stored {
+		if _, ok := db.pending[entryKey{e.Path, e.Algo}]; !ok {
+			entries = append(entries, e)
+		}
+	}
+	for _, e := range db.pending {
+		if e.Algo == algo && e.Size == size && e.Lastmod == modtime {
+			entries = append(entries, e)
+		}
+	}
+	db.mu.RUnlock()
+
+	for i := range entries {
+		entries[i].Path = db.resolve(entries[i].Path)
+	}
+	return entries, nil
+}
+
+// Rename moves the entries for the file at path, the fingerprints of its
+// transformed images and its distinct marks to newpath, replacing those
+// there.
+func (db *DB) Rename(ctx context.Context, path, newpath string, inode, dev uint64) error {
+	if err := db.flushPending(); err != nil {
+		return err
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	key, newkey := db.key(path), db.key(newpath)
+	if _, err := tx.ExecContext(ctx, "UPDATE OR REPLACE fingerprints SET path = ?, inode = ?, dev = ? WHERE path = ?",
+		newkey, int64(inode), int64(dev), key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE OR REPLACE variants SET path = ? WHERE path = ?", newkey, key); err != nil {
+		return err
+	}
+	for _, col := range []string{"a", "b"} {
+		if _, err := tx.ExecContext(ctx, "UPDATE OR REPLACE distinct_pairs SET "+col+" = ? WHERE "+col+" = ?", newkey, key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// moved looks for the entry of the file of the request m among those of the
+// files of the same size and modification time, which it is a moved or
+// copied file of if their inode and device numbers or partial checksums are
+// the same. The entry of a moved file is renamed; that of a copied one is
+// duplicated.
+func (f *Finder) moved(ctx context.Context, abspath string, m request) (Entry, bool, error) {
+	db, ok := f.opts.DB.(mover)
+	if !ok {
+		return Entry{}, false, nil
+	}
+	cands, err := db.candidates(ctx, f.opts.Hasher.Name(), m.size, m.modTime)
+	if err != nil || len(cands) == 0 {
+		return Entry{}, false, err
+	}
+
+	var partial string
+	for _, e := range cands {
+		if e.Path == abspath {
+			continue
+		}
+
+		if m.inode == 0 || e.Inode != m.inode || e.Dev != m.dev {
+			if e.Partial == "" {
+				continue
+			}
+			if partial == "" {
+				if partial, err = partialChecksum(m.path, m.size); err != nil {
+					return Entry{}, false, nil
+				}
+			}
+			if e.Partial != partial {
+				continue
+			}
+		}
+
+		oldpath := e.Path
+		e.Path, e.Inode, e.Dev = abspath, m.inode, m.dev
+		if f.opts.NewOnly {
+			return e, true, nil
+		}
+		if _, err := os.Lstat(oldpath); os.IsNotExist(err) {
+			return e, true, db.Rename(ctx, oldpath, abspath, m.inode, m.dev)
+		}
+		return e, true, f.opts.DB.Upsert(ctx, e)
+	}
+
+	return Entry{}, false, nil
+}
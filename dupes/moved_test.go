@@ -0,0 +1,178 @@
+package dupes
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPartialChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 3*partialSize)
+	write := func(name string) (string, int64) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path, int64(len(data))
+	}
+	sum := func(path string, size int64) string {
+		s, err := partialChecksum(path, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	a := sum(write("a"))
+	data[partialSize+1] = 1 // The middle is not hashed.
+	if b := sum(write("b")); b != a {
+		t.Errorf("checksums of files differing in the middle: %s != %s", b, a)
+	}
+	data[len(data)-1] = 1
+	if c := sum(write("c")); c == a {
+		t.Errorf("checksums of files differing at the end are equal")
+	}
+	data = data[:len(data)-1]
+	if d := sum(write("d")); d == a {
+		t.Errorf("checksums of files of different sizes are equal")
+	}
+}
+
+func TestFinderMoved(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mkdir := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a, b, c := mkdir("a"), mkdir("b"), mkdir("c")
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(64, 48, false)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(a, "x.png")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modtime := fi.ModTime().UnixNano()
+
+	ctx := context.Background()
+	finder := NewFinder(Options{Depth: -1, Hasher: AHash{}, DB: db})
+	scan := func(root string) []File {
+		files, err := finder.Scan(ctx, []string{root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	if files := scan(dir); len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+
+	// A fingerprint which the file would not be hashed to, so that it is
+	// known to be carried over.
+	e, ok, err := db.Get(ctx, path, "ahash", modtime)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	const fp = 0x0123456789abcdef
+	e.FP = fp
+	if err := db.Upsert(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	moved := filepath.Join(b, "y.png")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if files := scan(dir); len(files) != 1 || files[0].Path != moved || files[0].FP != fp {
+		t.Errorf("moved file: got %+v", files)
+	}
+	if _, ok, err := db.Get(ctx, path, "ahash", modtime); err != nil || ok {
+		t.Errorf("the entry of the old path is left: %v, %v", ok, err)
+	}
+
+	// The copy is scanned alone, so that it is not found to be a
+	// byte-identical copy of the other file.
+	copied := filepath.Join(c, "z.png")
+	if err := ioutil.WriteFile(copied, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(copied, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if files := scan(c); len(files) != 1 || files[0].Path != copied || files[0].FP != fp {
+		t.Errorf("copied file: got %+v", files)
+	}
+	if e, ok, err := db.Get(ctx, moved, "ahash", modtime); err != nil || !ok || e.FP != fp {
+		t.Errorf("the entry of the original file: got %+v, %v, %v", e, ok, err)
+	}
+}
+
+func TestCandidatesPending(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, e := range []Entry{
+		{Path: "/a.jpg", Algo: "dct", FP: 1, Lastmod: 1, Size: 10},
+		{Path: "/b.jpg", Algo: "dct", FP: 2, Lastmod: 1, Size: 10},
+		{Path: "/c.jpg", Algo: "dct", FP: 3, Lastmod: 2, Size: 10},
+	} {
+		if err := db.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.flushPending(); err != nil {
+		t.Fatal(err)
+	}
+	// /b.jpg is modified and /d.jpg is added, but they are not written.
+	for _, e := range []Entry{
+		{Path: "/b.jpg", Algo: "dct", FP: 2, Lastmod: 2, Size: 10},
+		{Path: "/d.jpg", Algo: "dct", FP: 4, Lastmod: 1, Size: 10},
+	} {
+		if err := db.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cands, err := db.candidates(ctx, "dct", 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range cands {
+		paths = append(paths, e.Path)
+	}
+	sort.Strings(paths)
+	if want := []string{"/a.jpg", "/d.jpg"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+}
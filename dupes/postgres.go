@@ -0,0 +1,372 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// A PostgreSQL database has the tables of an SQLite one, with the paths in
+// byte order (COLLATE "C") so that those under a directory sort together.
+// The paths are absolute; the library root is not supported.
+
+// postgresVersion is the version of the schema of PostgreSQL databases.
+const postgresVersion = 1
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS fingerprints (
+		path TEXT COLLATE "C", algo TEXT, fp BIGINT, lastmod BIGINT, size BIGINT,
+		orientation INTEGER, checksum TEXT, inode BIGINT, dev BIGINT, partial TEXT,
+		PRIMARY KEY (path, algo))`,
+	"CREATE INDEX IF NOT EXISTS fingerprints_size ON fingerprints (size, lastmod)",
+	`CREATE TABLE IF NOT EXISTS variants (
+		path TEXT COLLATE "C", algo TEXT, transform INTEGER, fp BIGINT, lastmod BIGINT,
+		PRIMARY KEY (path, algo, transform))`,
+	`CREATE TABLE IF NOT EXISTS distinct_pairs (a TEXT COLLATE "C", b TEXT COLLATE "C", PRIMARY KEY (a, b))`,
+}
+
+// PostgresDB is a fingerprint database backed by PostgreSQL, which several
+// hosts can share.
+type PostgresDB struct {
+	db *sql.DB
+}
+
+// OpenPostgres connects to the PostgreSQL fingerprint database at the URL
+// and creates the tables if they do not exist.
+func OpenPostgres(url string) (*PostgresDB, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := initPostgres(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresDB{db: db}, nil
+}
+
+// initPostgres creates the tables, while holding a lock, so that the hosts
+// connecting at the same time do not get in each other's way.
+func initPostgres(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('findimagedupes'))"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER)"); err != nil {
+		return err
+	}
+	var version int
+	switch err := tx.QueryRow("SELECT version FROM schema_version").Scan(&version); {
+	case err == sql.ErrNoRows:
+		if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES ($1)", postgresVersion); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case version > postgresVersion:
+		return fmt.Errorf("the database schema version %d is newer than the supported one (%d); upgrade findimagedupes", version, postgresVersion)
+	}
+	for _, q := range postgresSchema {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// rebind replaces the ? placeholders in the query q with $1, $2, etc.
+func rebind(q string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// postgresUpsert stores the values of entryColumns.
+var postgresUpsert = rebind("INSERT INTO fingerprints (" + entryColumns + ") VALUES (" + entryValues + `)
+	ON CONFLICT (path, algo) DO UPDATE SET fp = excluded.fp, lastmod = excluded.lastmod, size = excluded.size,
+		orientation = excluded.orientation, checksum = excluded.checksum, inode = excluded.inode,
+		dev = excluded.dev, partial = excluded.partial`)
+
+// Get implements FingerprintStore.Get.
+func (db *PostgresDB) Get(ctx context.Context, path, algo string, modtime int64) (Entry, bool, error) {
+	e, err := scanEntry(db.db.QueryRowContext(ctx, "SELECT "+entryColumns+" FROM fingerprints WHERE path = $1 AND algo = $2 AND lastmod = $3", path, algo, modtime))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// Upsert implements FingerprintStore.Upsert.
+func (db *PostgresDB) Upsert(ctx context.Context, e Entry) error {
+	_, err := db.db.ExecContext(ctx, postgresUpsert, e.values(e.Path)...)
+	return err
+}
+
+// GetAll implements FingerprintStore.GetAll.
+func (db *PostgresDB) GetAll(ctx context.Context, algo string) ([]Entry, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT path, fp FROM fingerprints WHERE algo = $1", algo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Entry
+	for rows.Next() {
+		var path string
+		var fp int64
+		if err := rows.Scan(&path, &fp); err != nil {
+			return nil, err
+		}
+		results = append(results, Entry{Path: path, Algo: algo, FP: uint64(fp)})
+	}
+	return results, rows.Err()
+}
+
+// GetVariants implements FingerprintStore.GetVariants.
+func (db *PostgresDB) GetVariants(ctx context.Context, path, algo string, modtime int64) ([]Variant, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT transform, fp FROM variants WHERE path = $1 AND algo = $2 AND lastmod = $3", path, algo, modtime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []Variant
+	for rows.Next() {
+		var t int
+		var fp int64
+		if err := rows.Scan(&t, &fp); err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{Transform: Transform(t), FP: uint64(fp)})
+	}
+	return variants, rows.Err()
+}
+
+// UpsertVariants implements FingerprintStore.UpsertVariants.
+func (db *PostgresDB) UpsertVariants(ctx context.Context, path, algo string, modtime int64, variants []Variant) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, v := range variants {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO variants (path, algo, transform, fp, lastmod) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (path, algo, transform) DO UPDATE SET fp = excluded.fp, lastmod = excluded.lastmod`,
+			path, algo, int(v.Transform), int64(v.FP), modtime); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// candidates implements mover; see DB.candidates.
+func (db *PostgresDB) candidates(ctx context.Context, algo string, size, modtime int64) ([]Entry, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT "+entryColumns+" FROM fingerprints WHERE size = $1 AND lastmod = $2 AND algo = $3", size, modtime, algo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Rename implements mover; see DB.Rename.
+func (db *PostgresDB) Rename(ctx context.Context, path, newpath string, inode, dev uint64) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE path = $2 AND algo IN (SELECT algo FROM fingerprints WHERE path = $1)", path, newpath); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE fingerprints SET path = $2, inode = $3, dev = $4 WHERE path = $1", path, newpath, int64(inode), int64(dev)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM variants WHERE path = $2 AND algo IN (SELECT algo FROM variants WHERE path = $1)", path, newpath); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE variants SET path = $2 WHERE path = $1", path, newpath); err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"UPDATE distinct_pairs p SET a = $2 WHERE a = $1 AND NOT EXISTS (SELECT 1 FROM distinct_pairs WHERE a = $2 AND b = p.b)",
+		"UPDATE distinct_pairs p SET b = $2 WHERE b = $1 AND NOT EXISTS (SELECT 1 FROM distinct_pairs WHERE a = p.a AND b = $2)",
+		"DELETE FROM distinct_pairs WHERE a = $1 OR b = $1",
+	} {
+		if _, err := tx.ExecContext(ctx, q, path, newpath); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Prune implements FingerprintStore.Prune.
+func (db *PostgresDB) Prune(ctx context.Context, opts PruneOptions) (PruneStats, error) {
+	q := "SELECT " + entryColumns + " FROM fingerprints WHERE (path, algo) > (?, ?)"
+	var under []interface{}
+	if opts.Under != "" {
+		var cond string
+		cond, under = prefixCond("path", opts.Under, filepath.Separator)
+		q += " AND " + cond
+	}
+	q = rebind(q + " ORDER BY path, algo LIMIT ?")
+
+	var st PruneStats
+	var last Entry
+	for {
+		var batch []Entry
+		args := append([]interface{}{last.Path, last.Algo}, under...)
+		rows, err := db.db.QueryContext(ctx, q, append(args, pruneBatch)...)
+		if err != nil {
+			return st, err
+		}
+		for rows.Next() {
+			e, err := scanEntry(rows)
+			if err != nil {
+				rows.Close()
+				return st, err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return st, err
+		}
+		if len(batch) == 0 {
+			return st, nil
+		}
+		last = batch[len(batch)-1]
+
+		removed, refreshed := checkEntries(ctx, batch, func(path string) string { return path }, opts)
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		if err := db.applyPrune(ctx, removed, refreshed); err != nil {
+			return st, err
+		}
+		st.Checked += len(batch)
+		st.Removed += len(removed)
+		st.Refreshed += len(refreshed)
+	}
+}
+
+// applyPrune is DB.applyPrune for PostgreSQL.
+func (db *PostgresDB) applyPrune(ctx context.Context, removed, refreshed []Entry) error {
+	if len(removed) == 0 && len(refreshed) == 0 {
+		return nil
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, e := range removed {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE path = $1 AND algo = $2", e.Path, e.Algo); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM distinct_pairs WHERE a = $1 OR b = $1", e.Path); err != nil {
+			return err
+		}
+	}
+	for _, e := range append(removed, refreshed...) {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM variants WHERE path = $1 AND algo = $2", e.Path, e.Algo); err != nil {
+			return err
+		}
+	}
+	for _, e := range refreshed {
+		if _, err := tx.ExecContext(ctx, postgresUpsert, e.values(e.Path)...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MarkDistinct implements FingerprintStore.MarkDistinct.
+func (db *PostgresDB) MarkDistinct(ctx context.Context, a, b string) error {
+	p := distinctPair(a, b)
+	_, err := db.db.ExecContext(ctx, "INSERT INTO distinct_pairs (a, b) VALUES ($1, $2) ON CONFLICT DO NOTHING", p[0], p[1])
+	return err
+}
+
+// DistinctPairs implements FingerprintStore.DistinctPairs.
+func (db *PostgresDB) DistinctPairs(ctx context.Context) ([][2]string, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT a, b FROM distinct_pairs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs [][2]string
+	for rows.Next() {
+		var a, b string
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]string{a, b})
+	}
+	return pairs, rows.Err()
+}
+
+// Close closes the connections to the database.
+func (db *PostgresDB) Close() error {
+	return db.db.Close()
+}
@@ -0,0 +1,142 @@
+package dupes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	got := rebind("SELECT fp FROM fingerprints WHERE path = ? AND algo = ?")
+	if want := "SELECT fp FROM fingerprints WHERE path = $1 AND algo = $2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// openTestPostgres connects twice, as two hosts would, to the scratch
+// PostgreSQL database at $FINDIMAGEDUPES_TEST_POSTGRES, emptied first; the
+// test is skipped if it is not set.
+func openTestPostgres(t *testing.T) (*PostgresDB, *PostgresDB) {
+	url := os.Getenv("FINDIMAGEDUPES_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("FINDIMAGEDUPES_TEST_POSTGRES is not set")
+	}
+
+	db, err := OpenPostgres(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec("DROP TABLE fingerprints, variants, distinct_pairs, schema_version"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var dbs [2]*PostgresDB
+	for i := range dbs {
+		if dbs[i], err = OpenPostgres(url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dbs[0], dbs[1]
+}
+
+func TestPostgres(t *testing.T) {
+	db1, db2 := openTestPostgres(t)
+	defer db1.Close()
+	defer db2.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i, db := range []*PostgresDB{db1, db2} {
+		wg.Add(1)
+		go func(i int, db *PostgresDB) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// Both hosts store the odd entries.
+				if j%2 == 0 && j%4 != 2*i {
+					continue
+				}
+				e := Entry{Path: fmt.Sprintf("/img/%d.jpg", j), Algo: "dct", FP: uint64(j), Lastmod: 1, Checksum: "abc"}
+				if err := db.Upsert(ctx, e); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, db)
+	}
+	wg.Wait()
+
+	all, err := db2.GetAll(ctx, "dct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 100 {
+		t.Errorf("GetAll: got %d entries, want 100", len(all))
+	}
+
+	want := Entry{Path: "/img/1.jpg", Algo: "dct", FP: 42, Lastmod: 2, Size: 10, Orientation: 1, Inode: 3, Dev: 4, Partial: "def"}
+	if err := db1.Upsert(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok, err := db2.Get(ctx, want.Path, "dct", 2); err != nil || !ok || e != want {
+		t.Errorf("Get: got %+v, %v, %v; want %+v", e, ok, err, want)
+	}
+
+	variants := []Variant{{Transform: 1, FP: 5}, {Transform: 2, FP: 6}}
+	if err := db1.UpsertVariants(ctx, want.Path, "dct", 2, variants); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Rename(ctx, want.Path, "/img/0.jpg", 7, 8); err != nil {
+		t.Fatal(err)
+	}
+	want.Path, want.Inode, want.Dev = "/img/0.jpg", 7, 8
+	if e, ok, err := db1.Get(ctx, want.Path, "dct", 2); err != nil || !ok || e != want {
+		t.Errorf("Get after Rename: got %+v, %v, %v; want %+v", e, ok, err, want)
+	}
+	if v, err := db1.GetVariants(ctx, want.Path, "dct", 2); err != nil || len(v) != 2 {
+		t.Errorf("GetVariants after Rename: got %v, %v", v, err)
+	}
+}
+
+func TestPostgresPrune(t *testing.T) {
+	db, db2 := openTestPostgres(t)
+	defer db.Close()
+	db2.Close()
+
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kept := filepath.Join(dir, "kept.jpg")
+	if err := ioutil.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, e := range []Entry{
+		{Path: kept, Algo: "dct", FP: 1, Lastmod: fi.ModTime().UnixNano()},
+		{Path: filepath.Join(dir, "gone.jpg"), Algo: "dct", FP: 2, Lastmod: 1},
+		{Path: filepath.Join(dir+"x", "gone.jpg"), Algo: "dct", FP: 3, Lastmod: 1},
+	} {
+		if err := db.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := db.Prune(ctx, PruneOptions{Under: dir, Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (PruneStats{Checked: 2, Removed: 1}); st != want {
+		t.Errorf("under %s: got %+v, want %+v", dir, st, want)
+	}
+}
@@ -0,0 +1,246 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// pruneBatch is the number of entries checked by Prune between commits.
+const pruneBatch = 1000
+
+// PruneOptions configure Prune.
+type PruneOptions struct {
+	// Under, if not empty, limits the sweep to the entries for that path
+	// and the paths under it.
+	Under string
+
+	// Jobs is the number of files to check concurrently;
+	// runtime.NumCPU() if zero or negative.
+	Jobs int
+
+	// Log is used to report errors.
+	Log Logger
+
+	// Progress, if not nil, is called with every path checked.
+	Progress func(path string)
+}
+
+// PruneStats are the numbers of entries checked, removed and refreshed by
+// Prune.
+type PruneStats struct {
+	Checked, Removed, Refreshed int
+}
+
+// Prune implements FingerprintStore.Prune.
+func (db *DB) Prune(ctx context.Context, opts PruneOptions) (PruneStats, error) {
+	if err := db.flushPending(); err != nil {
+		return PruneStats{}, err
+	}
+
+	q := "SELECT " + entryColumns + " FROM fingerprints WHERE (path, algo) > (?, ?)"
+	var under []interface{}
+	if opts.Under != "" {
+		var cond string
+		cond, under = db.under("path", opts.Under)
+		q += " AND " + cond
+	}
+	q += " ORDER BY path, algo LIMIT ?"
+
+	var st PruneStats
+	var last Entry
+	for {
+		var batch []Entry
+		args := append([]interface{}{last.Path, last.Algo}, under...)
+		rows, err := db.db.QueryContext(ctx, q, append(args, pruneBatch)...)
+		if err != nil {
+			return st, err
+		}
+		for rows.Next() {
+			e, err := scanEntry(rows)
+			if err != nil {
+				rows.Close()
+				return st, err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return st, err
+		}
+		if len(batch) == 0 {
+			return st, nil
+		}
+		last = batch[len(batch)-1]
+
+		removed, refreshed := checkEntries(ctx, batch, db.resolve, opts)
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		if err := db.applyPrune(ctx, removed, refreshed); err != nil {
+			return st, err
+		}
+		st.Checked += len(batch)
+		st.Removed += len(removed)
+		st.Refreshed += len(refreshed)
+	}
+}
+
+// checkEntries checks the files of the entries, stored under the paths
+// resolve maps to theirs, concurrently. It returns the entries for the files
+// which do not exist any more, and the refreshed entries for those modified
+// since.
+func checkEntries(ctx context.Context, batch []Entry, resolve func(string) string, opts PruneOptions) (removed, refreshed []Entry) {
+	if opts.Log == nil {
+		opts.Log = nopLogger{}
+	}
+	if opts.Jobs <= 0 {
+		opts.Jobs = runtime.NumCPU()
+	}
+
+	work := make(chan Entry)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				e, ok, err := recheck(e, resolve(e.Path))
+				switch {
+				case os.IsNotExist(err):
+					mu.Lock()
+					removed = append(removed, e)
+					mu.Unlock()
+				case err != nil:
+					opts.Log.Errorf("ERROR: %v", err)
+				case ok:
+					mu.Lock()
+					refreshed = append(refreshed, e)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+loop:
+	for _, e := range batch {
+		if opts.Progress != nil {
+			opts.Progress(resolve(e.Path))
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case work <- e:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return removed, refreshed
+}
+
+// recheck returns the entry e for the file at path refreshed if the file
+// has been modified since it was stored, and whether it has been.
+func recheck(e Entry, path string) (Entry, bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return e, false, err
+	}
+
+	lastmod := fi.ModTime().UnixNano()
+	if e.Lastmod == lastmod {
+		return e, false, nil
+	}
+
+	hasher, err := HasherByName(e.Algo)
+	if err != nil {
+		return e, false, err
+	}
+	fp, orientation, err := fingerprint(hasher, path, e.Orientation != 0)
+	if err != nil {
+		return e, false, nil
+	}
+
+	e.FP, e.Lastmod, e.Size, e.Orientation = fp, lastmod, fi.Size(), orientation
+	e.Checksum = ""
+	e.Inode, e.Dev = fileID(fi)
+	e.Partial, _ = partialChecksum(path, fi.Size())
+	return e, true, nil
+}
+
+// applyPrune removes the removed entries, and the distinct marks of their
+// files, and stores the refreshed ones. The variants of both are removed;
+// those of the modified files are computed again on demand.
+func (db *DB) applyPrune(ctx context.Context, removed, refreshed []Entry) error {
+	if len(removed) == 0 && len(refreshed) == 0 {
+		return nil
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	del, err := tx.PrepareContext(ctx, "DELETE FROM fingerprints WHERE path = ? AND algo = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+	delVariants, err := tx.PrepareContext(ctx, "DELETE FROM variants WHERE path = ? AND algo = ?")
+	if err != nil {
+		return err
+	}
+	defer delVariants.Close()
+	delDistinct, err := tx.PrepareContext(ctx, "DELETE FROM distinct_pairs WHERE a = ? OR b = ?")
+	if err != nil {
+		return err
+	}
+	defer delDistinct.Close()
+	upsert, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO fingerprints ("+entryColumns+") VALUES ("+entryValues+")")
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+
+	for _, e := range removed {
+		if _, err := del.ExecContext(ctx, e.Path, e.Algo); err != nil {
+			return err
+		}
+		if _, err := delDistinct.ExecContext(ctx, e.Path, e.Path); err != nil {
+			return err
+		}
+	}
+	for _, e := range append(removed, refreshed...) {
+		if _, err := delVariants.ExecContext(ctx, e.Path, e.Algo); err != nil {
+			return err
+		}
+	}
+	for _, e := range refreshed {
+		if _, err := upsert.ExecContext(ctx, e.values(e.Path)...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
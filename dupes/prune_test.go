@@ -0,0 +1,63 @@
+package dupes
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kept := filepath.Join(dir, "kept.jpg")
+	if err := ioutil.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, e := range []Entry{
+		{Path: kept, Algo: "dct", FP: 1, Lastmod: fi.ModTime().UnixNano()},
+		{Path: filepath.Join(dir, "gone.jpg"), Algo: "dct", FP: 2, Lastmod: 1},
+		{Path: filepath.Join(dir+"x", "gone.jpg"), Algo: "dct", FP: 3, Lastmod: 1},
+	} {
+		if err := db.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.MarkDistinct(ctx, kept, filepath.Join(dir, "gone.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := db.Prune(ctx, PruneOptions{Under: dir, Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (PruneStats{Checked: 2, Removed: 1}); st != want {
+		t.Errorf("under %s: got %+v, want %+v", dir, st, want)
+	}
+	if pairs, err := db.DistinctPairs(ctx); err != nil || len(pairs) != 0 {
+		t.Errorf("got distinct pairs %v, %v; want none", pairs, err)
+	}
+
+	st, err = db.Prune(ctx, PruneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (PruneStats{Checked: 2, Removed: 1}); st != want {
+		t.Errorf("got %+v, want %+v", st, want)
+	}
+}
@@ -0,0 +1,72 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+
+	"gitlab.com/opennota/phash"
+)
+
+// Match is an entry of the fingerprint database similar to a queried image.
+type Match struct {
+	Path     string
+	FP       uint64
+	Distance int
+}
+
+// Query fingerprints the image at path and returns its fingerprint and the
+// k entries of DB, other than that of path, nearest to it within Threshold,
+// nearest first; all of them if k is zero or negative. No directories are
+// walked and the fingerprint is not stored.
+func (f *Finder) Query(ctx context.Context, path string, k int) (uint64, []Match, error) {
+	if f.opts.DB == nil {
+		return 0, nil, errors.New("no fingerprint database")
+	}
+
+	fp, _, err := fingerprint(f.opts.Hasher, path, !f.opts.IgnoreOrientation)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	entries, err := f.opts.DB.GetAll(ctx, f.opts.Hasher.Name())
+	if err != nil {
+		return fp, nil, err
+	}
+
+	abspath, _ := filepath.Abs(path)
+	var matches []Match
+	for _, e := range entries {
+		if e.Path == abspath {
+			continue
+		}
+		if d := phash.HammingDistance(fp, e.FP); d <= f.opts.Threshold {
+			matches = append(matches, Match{Path: e.Path, FP: e.FP, Distance: d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Path < matches[j].Path
+	})
+	if k > 0 && len(matches) > k {
+		matches = matches[:k]
+	}
+
+	return fp, matches, nil
+}
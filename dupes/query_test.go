@@ -0,0 +1,73 @@
+package dupes
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	img.Set(0, 0, color.White)
+	path := filepath.Join(dir, "q.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fp, _, err := fingerprint(AHash{}, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, e := range []Entry{
+		{Path: path, Algo: "ahash", FP: fp},
+		{Path: "/far.png", Algo: "ahash", FP: fp ^ 0xff},
+		{Path: "/near.png", Algo: "ahash", FP: fp ^ 1},
+		{Path: "/same.png", Algo: "ahash", FP: fp},
+		{Path: "/other.png", Algo: "dct", FP: fp},
+	} {
+		if err := db.Upsert(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	finder := NewFinder(Options{Threshold: 1, Hasher: AHash{}, DB: db})
+	got, matches, err := finder.Query(ctx, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != fp {
+		t.Errorf("got fingerprint %016x, want %016x", got, fp)
+	}
+	want := []Match{{Path: "/same.png", FP: fp}, {Path: "/near.png", FP: fp ^ 1, Distance: 1}}
+	if !reflect.DeepEqual(matches, want) {
+		t.Errorf("got %v, want %v", matches, want)
+	}
+
+	if _, matches, _ := finder.Query(ctx, path, 1); len(matches) != 1 {
+		t.Errorf("got %d matches, want 1", len(matches))
+	}
+}
@@ -0,0 +1,128 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+)
+
+// The paths of the files under the library root are stored relative to it,
+// with forward slashes, so that the library can be moved or mounted
+// elsewhere; the other paths are stored as they are.
+
+// getMeta returns the value of the metadata key, or "" if it is not set.
+func getMeta(ctx context.Context, db *sql.DB, key string) (string, error) {
+	var value string
+	err := db.QueryRowContext(ctx, "SELECT value FROM meta WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// Root returns the library root, or "" if none is set.
+func (db *DB) Root() string {
+	return db.root
+}
+
+// SetRoot sets the library root to dir. The entries and the distinct marks
+// for the files under dir stored with absolute paths are converted. SetRoot
+// must not be called concurrently with the other methods.
+func (db *DB) SetRoot(ctx context.Context, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := db.flushPending(); err != nil {
+		return err
+	}
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO meta (key, value) VALUES ('root', ?)", dir); err != nil {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	for _, c := range []struct{ table, col string }{
+		{"fingerprints", "path"},
+		{"variants", "path"},
+		{"distinct_pairs", "a"},
+		{"distinct_pairs", "b"},
+	} {
+		rows, err := tx.QueryContext(ctx, "SELECT DISTINCT "+c.col+" FROM "+c.table+" WHERE "+c.col+" >= ? AND "+c.col+" < ?",
+			prefix, prefix[:len(prefix)-1]+string(filepath.Separator+1))
+		if err != nil {
+			return err
+		}
+		var paths []string
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				rows.Close()
+				return err
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			key := filepath.ToSlash(path[len(prefix):])
+			if _, err := tx.ExecContext(ctx, "UPDATE OR REPLACE "+c.table+" SET "+c.col+" = ? WHERE "+c.col+" = ?", key, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.root = dir
+	return nil
+}
+
+// key returns the path under which the file at the absolute path is stored.
+func (db *DB) key(path string) string {
+	if db.root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(db.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// resolve returns the absolute path of the file stored under key.
+func (db *DB) resolve(key string) string {
+	if db.root == "" || filepath.IsAbs(key) {
+		return key
+	}
+	return filepath.Join(db.root, filepath.FromSlash(key))
+}
@@ -0,0 +1,61 @@
+package dupes
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, path := range []string{"/mnt/photos/a.jpg", "/mnt/photos/x/b.jpg", "/mnt/other/c.jpg"} {
+		if err := db.Upsert(ctx, Entry{Path: path, Algo: "dct", FP: 1, Lastmod: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.MarkDistinct(ctx, "/mnt/photos/a.jpg", "/mnt/other/c.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetRoot(ctx, "/mnt/photos"); err != nil {
+		t.Fatal(err)
+	}
+	// The library is mounted elsewhere.
+	if err := db.SetRoot(ctx, "/media/photos"); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]bool{
+		"/media/photos/a.jpg":   true,
+		"/media/photos/x/b.jpg": true,
+		"/mnt/photos/a.jpg":     false,
+		"/mnt/other/c.jpg":      true,
+	} {
+		if _, ok, err := db.Get(ctx, path, "dct", 1); err != nil || ok != want {
+			t.Errorf("%s: got %v, %v; want %v", path, ok, err, want)
+		}
+	}
+
+	pairs, err := db.DistinctPairs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]string{{"/mnt/other/c.jpg", "/media/photos/a.jpg"}}; !reflect.DeepEqual(pairs, want) {
+		t.Errorf("got distinct pairs %v, want %v", pairs, want)
+	}
+
+	n, err := db.Forget(ctx, "/media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d entries removed, want 2", n)
+	}
+	if pairs, err := db.DistinctPairs(ctx); err != nil || len(pairs) != 0 {
+		t.Errorf("got distinct pairs %v, %v; want none", pairs, err)
+	}
+}
@@ -0,0 +1,103 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// FingerprintStore is a fingerprint database.
+type FingerprintStore interface {
+	// Get returns the entry for the fingerprint computed by the
+	// algorithm algo stored for path, provided that the file has not
+	// been modified since.
+	Get(ctx context.Context, path, algo string, modtime int64) (Entry, bool, error)
+
+	// Upsert stores the entry.
+	Upsert(ctx context.Context, e Entry) error
+
+	// GetAll returns all the entries computed by the algorithm algo.
+	GetAll(ctx context.Context, algo string) ([]Entry, error)
+
+	// GetVariants returns the fingerprints of the transformed images
+	// computed by the algorithm algo stored for path, provided that the
+	// file has not been modified since.
+	GetVariants(ctx context.Context, path, algo string, modtime int64) ([]Variant, error)
+
+	// UpsertVariants stores the fingerprints of the transformed images
+	// of path computed by the algorithm algo.
+	UpsertVariants(ctx context.Context, path, algo string, modtime int64, variants []Variant) error
+
+	// Prune removes the entries and the distinct marks for files which
+	// do not exist any more and refreshes the fingerprints of files
+	// modified since. The changes are committed in batches, so that
+	// those made before an error or cancellation are kept.
+	Prune(ctx context.Context, opts PruneOptions) (PruneStats, error)
+
+	// MarkDistinct records that the files at the paths a and b are not
+	// duplicates of each other.
+	MarkDistinct(ctx context.Context, a, b string) error
+
+	// DistinctPairs returns the pairs of paths of the files marked as
+	// not duplicates of each other.
+	DistinctPairs(ctx context.Context) ([][2]string, error)
+
+	// Close closes the database.
+	Close() error
+}
+
+// mover is implemented by the stores which can find the entries of moved
+// files; see moved.go.
+type mover interface {
+	candidates(ctx context.Context, algo string, size, modtime int64) ([]Entry, error)
+	Rename(ctx context.Context, path, newpath string, inode, dev uint64) error
+}
+
+// Backends lists the names accepted by OpenStore.
+var Backends = []string{"sqlite", "bolt", "postgres"}
+
+// BackendOf returns the name of the backend for the database at path:
+// postgres for the postgres:// and postgresql:// URLs, bolt for the .bolt
+// and .bbolt files, sqlite for the others.
+func BackendOf(path string) string {
+	if strings.HasPrefix(path, "postgres://") || strings.HasPrefix(path, "postgresql://") {
+		return "postgres"
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bolt", ".bbolt":
+		return "bolt"
+	}
+	return "sqlite"
+}
+
+// OpenStore opens or creates the fingerprint database at path, a file name
+// or a URL, with the named backend, or with that BackendOf returns if
+// backend is empty.
+func OpenStore(path, backend string) (FingerprintStore, error) {
+	if backend == "" {
+		backend = BackendOf(path)
+	}
+	switch backend {
+	case "sqlite":
+		return OpenDatabase(path)
+	case "bolt":
+		return OpenBolt(path)
+	case "postgres":
+		return OpenPostgres(path)
+	}
+	return nil, fmt.Errorf("unknown database backend: %s", backend)
+}
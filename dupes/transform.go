@@ -0,0 +1,153 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+)
+
+// Transform is one of the eight rotations and reflections of an image.
+type Transform int
+
+const (
+	Identity   Transform = iota
+	Rotate90             // Clockwise.
+	Rotate180            //
+	Rotate270            // Clockwise.
+	FlipH                // Mirror left to right.
+	FlipV                // Mirror top to bottom.
+	Transpose            // Mirror along the top-left to bottom-right diagonal.
+	Transverse           // Mirror along the top-right to bottom-left diagonal.
+)
+
+var transformNames = []string{
+	"identity",
+	"rotate90",
+	"rotate180",
+	"rotate270",
+	"flip-h",
+	"flip-v",
+	"transpose",
+	"transverse",
+}
+
+func (t Transform) String() string {
+	if t < 0 || int(t) >= len(transformNames) {
+		return fmt.Sprintf("Transform(%d)", int(t))
+	}
+	return transformNames[t]
+}
+
+// ParseInvariance returns the transforms to be tried for a comma-separated
+// list of invariances: rotate and flip.
+func ParseInvariance(s string) ([]Transform, error) {
+	var rotate, flip bool
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "rotate":
+			rotate = true
+		case "flip":
+			flip = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown invariance: %s", name)
+		}
+	}
+
+	switch {
+	case rotate && flip:
+		return []Transform{Rotate90, Rotate180, Rotate270, FlipH, FlipV, Transpose, Transverse}, nil
+	case rotate:
+		return []Transform{Rotate90, Rotate180, Rotate270}, nil
+	case flip:
+		return []Transform{FlipH, FlipV}, nil
+	}
+	return nil, nil
+}
+
+// Apply returns img transformed by t.
+func (t Transform) Apply(img image.Image) image.Image {
+	if t == Identity {
+		return img
+	}
+
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if t == Rotate90 || t == Rotate270 || t == Transpose || t == Transverse {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		si := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+y)
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch t {
+			case Rotate90:
+				dx, dy = h-1-y, x
+			case Rotate180:
+				dx, dy = w-1-x, h-1-y
+			case Rotate270:
+				dx, dy = y, w-1-x
+			case FlipH:
+				dx, dy = w-1-x, y
+			case FlipV:
+				dx, dy = x, h-1-y
+			case Transpose:
+				dx, dy = y, x
+			case Transverse:
+				dx, dy = h-1-y, w-1-x
+			}
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si+4*x:si+4*x+4])
+		}
+	}
+
+	return dst
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// Variant is the fingerprint of a transformed image.
+type Variant struct {
+	Transform Transform
+	FP        uint64
+}
+
+// hashVariants returns the fingerprints of img transformed by every one of
+// transforms, computed like those of the image files.
+func hashVariants(h Hasher, img image.Image, transforms []Transform) ([]Variant, error) {
+	img = toRGBA(img)
+	variants := make([]Variant, len(transforms))
+	for i, t := range transforms {
+		fp, err := h.Hash(t.Apply(img))
+		if err != nil {
+			return nil, err
+		}
+		variants[i] = Variant{Transform: t, FP: fp}
+	}
+	return variants, nil
+}
@@ -0,0 +1,71 @@
+package dupes
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTransformApply(t *testing.T) {
+	src := toRGBA(testImage(5, 3, false))
+
+	apply := func(img image.Image, ts ...Transform) *image.RGBA {
+		for _, t := range ts {
+			img = t.Apply(img)
+		}
+		return toRGBA(img)
+	}
+
+	for _, tc := range []struct {
+		a, b []Transform
+	}{
+		{[]Transform{Rotate90, Rotate90, Rotate90, Rotate90}, nil},
+		{[]Transform{Rotate90, Rotate90}, []Transform{Rotate180}},
+		{[]Transform{Rotate90, Rotate180}, []Transform{Rotate270}},
+		{[]Transform{FlipH, FlipH}, nil},
+		{[]Transform{FlipH, FlipV}, []Transform{Rotate180}},
+		{[]Transform{Rotate90, FlipH}, []Transform{Transpose}},
+		{[]Transform{Rotate90, FlipV}, []Transform{Transverse}},
+	} {
+		a, b := apply(src, tc.a...), apply(src, tc.b...)
+		if !reflect.DeepEqual(a.Pix, b.Pix) || a.Rect != b.Rect {
+			t.Errorf("%v != %v", tc.a, tc.b)
+		}
+	}
+}
+
+func TestHashVariantsMatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := testImage(64, 48, false)
+	path := filepath.Join(dir, "a.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The variants are comparable with the fingerprints of the files.
+	want, err := HashFile(DCT{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants, err := hashVariants(DCT{}, img, []Transform{Identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants[0].FP != want {
+		t.Errorf("got %016x, want %016x", variants[0].FP, want)
+	}
+}
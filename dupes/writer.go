@@ -0,0 +1,123 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dupes
+
+import (
+	"context"
+	"time"
+)
+
+// The entries stored by Upsert are kept in DB.pending, where Get finds them,
+// until a background goroutine writes them in a single transaction, which
+// it does when writeBatch of them are pending, every writeDelay and on
+// Close.
+
+const (
+	writeBatch = 256
+	writeDelay = 200 * time.Millisecond
+)
+
+// entryKey identifies an entry: the path it is stored under and the
+// algorithm.
+type entryKey struct {
+	path, algo string
+}
+
+// writer writes the pending entries until db.flush is closed.
+func (db *DB) writer() {
+	defer close(db.done)
+
+	t := time.NewTicker(writeDelay)
+	defer t.Stop()
+	for {
+		select {
+		case _, ok := <-db.flush:
+			if !ok {
+				db.writePending()
+				return
+			}
+		case <-t.C:
+		}
+		db.writePending()
+	}
+}
+
+// writePending writes the pending entries. They are written even if the
+// scan that computed them is cancelled.
+func (db *DB) writePending() {
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	db.mu.RLock()
+	batch := make([]Entry, 0, len(db.pending))
+	for _, e := range db.pending {
+		batch = append(batch, e)
+	}
+	db.mu.RUnlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	err := db.writeEntries(context.Background(), batch)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err != nil && db.err == nil {
+		db.err = err
+	}
+	for _, e := range batch {
+		// Keep the entries stored again in the meantime.
+		k := entryKey{e.Path, e.Algo}
+		if db.pending[k] == e {
+			delete(db.pending, k)
+		}
+	}
+}
+
+// writeEntries writes the entries, stored under their paths, in a
+// transaction.
+func (db *DB) writeEntries(ctx context.Context, entries []Entry) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO fingerprints ("+entryColumns+") VALUES ("+entryValues+")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, e.values(e.Path)...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// flushPending writes the pending entries for the methods which query the
+// fingerprints table directly, and returns the error writing them if any.
+func (db *DB) flushPending() error {
+	db.writePending()
+	db.mu.Lock()
+	err := db.err
+	db.err = nil
+	db.mu.Unlock()
+	return err
+}
@@ -0,0 +1,61 @@
+package dupes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBatchedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "findimagedupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbpath := filepath.Join(dir, "fp.db")
+	db, err := OpenDatabase(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	const n = 3*writeBatch + 1
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < n; j += 4 {
+				path := fmt.Sprintf("/%d.jpg", j)
+				if err := db.Upsert(ctx, Entry{Path: path, Algo: "dct", FP: uint64(j), Lastmod: 1}); err != nil {
+					t.Error(err)
+				}
+				if e, ok, err := db.Get(ctx, path, "dct", 1); err != nil || !ok || e.FP != uint64(j) {
+					t.Errorf("%s: got %v, %v, %v", path, e, ok, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDatabase(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Entries != n {
+		t.Errorf("%d entries stored, want %d", st.Entries, n)
+	}
+}
@@ -1,9 +1,12 @@
 module gitlab.com/opennota/findimagedupes
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.11
 	github.com/rakyll/magicmime v0.1.0
 	gitlab.com/opennota/phash v1.0.2
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/image v0.10.0
 )
 
 go 1.13
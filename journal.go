@@ -0,0 +1,113 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// journalRecord describes a file replaced or moved by findimagedupes.
+type journalRecord struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Target string    `json:"target"`
+}
+
+// journal is an append-only log of the changes made to the file system,
+// one JSON record per line. The file is created on the first record.
+type journal struct {
+	path string
+	f    *os.File
+	enc  *json.Encoder
+	n    int // Number of records written.
+}
+
+// defaultJournalPath returns a new journal file name in dir.
+func defaultJournalPath(dir string) string {
+	return fmt.Sprintf("%s%cfindimagedupes-%s.journal", dir, os.PathSeparator, time.Now().Format("20060102-150405"))
+}
+
+func newJournal(path string) *journal {
+	return &journal{path: path}
+}
+
+// open creates the journal file, so that a journal which cannot be written
+// is noticed before any change is made.
+func (j *journal) open() error {
+	if j.f != nil {
+		return nil
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.enc = json.NewEncoder(f)
+	return nil
+}
+
+func (j *journal) record(op, path, target string) error {
+	if err := j.open(); err != nil {
+		return err
+	}
+	if err := j.enc.Encode(journalRecord{
+		Time:   time.Now(),
+		Op:     op,
+		Path:   path,
+		Target: target,
+	}); err != nil {
+		return err
+	}
+	j.n++
+	return nil
+}
+
+// Close closes the journal file, removing it if it is empty.
+func (j *journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	fi, err := j.f.Stat()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fi.Size() == 0 {
+		err = os.Remove(j.path)
+	}
+	return err
+}
+
+// readJournal returns the records of the journal at path.
+func readJournal(path string) ([]journalRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []journalRecord
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var r journalRecord
+		if err := dec.Decode(&r); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
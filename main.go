@@ -25,23 +25,13 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/rakyll/magicmime"
-	"gitlab.com/opennota/phash"
+	"gitlab.com/opennota/findimagedupes/dupes"
 )
 
-var (
-	log          quietVar
-	justCheckNew bool
-)
-
-type result struct {
-	fp   uint64
-	path string
-}
+var log quietVar
 
 type quotedString string
 
@@ -56,140 +46,15 @@ func (q *quotedString) Set(val string) error {
 	return nil
 }
 
-func resultWorker(m map[uint64][]string, in <-chan result, done chan struct{}) {
-	for r := range in {
-		m[r.fp] = append(m[r.fp], r.path)
-	}
-
-	close(done)
-}
-
-type request struct {
-	path    string
-	modTime int64
-}
-
-func worker(ctx context.Context, db *DB, in <-chan request, out chan<- result, done chan struct{}) {
-	defer close(done)
-
-	mm, err := magicmime.NewDecoder(magicmime.MAGIC_MIME_TYPE | magicmime.MAGIC_SYMLINK | magicmime.MAGIC_ERROR)
-	if err != nil {
-		panic(err)
-	}
-	defer mm.Close()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case m, open := <-in:
-			if !open {
-				return
-			}
-
-			var abspath string
-			var fp uint64
-			haveFP := false
-
-			if db != nil {
-				abspath, _ = filepath.Abs(m.path)
-				var err error
-				fp, haveFP, err = db.Get(ctx, abspath, m.modTime)
-				switch {
-				case err == context.Canceled:
-					return
-				case err != nil:
-					log.Error("ERROR:", err)
-				}
-			}
-
-			if !haveFP {
-				mimetype, err := mm.TypeByFile(m.path)
-				if err != nil {
-					log.Warnf("WARNING: %s: %v", m.path, err)
-					continue
-				}
-
-				if !strings.HasPrefix(mimetype, "image/") {
-					continue
-				}
-
-				fp, err = phash.ImageHashDCT(m.path)
-				if err != nil {
-					log.Warnf("WARNING: %s: %v", m.path, err)
-					continue
-				}
+type stringListFlags []string
 
-				if db != nil && !justCheckNew {
-					err := db.Upsert(ctx, abspath, m.modTime, fp)
-					switch {
-					case err == context.Canceled:
-						return
-					case err != nil:
-						log.Error("ERROR:", err)
-					}
-				}
-			}
-
-			res := result{fp: fp, path: m.path}
-			select {
-			case <-ctx.Done():
-				return
-			case out <- res:
-			}
-		}
-	}
+func (f *stringListFlags) String() string {
+	return strings.Join(*f, " ")
 }
 
-func process(ctx context.Context, depth int, excludeRegexps []*regexp.Regexp, spinner *Spinner, work chan<- request) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		spinner.Spin(path)
-
-		if err != nil {
-			log.Warnf("WARNING: %s: %v", path, err)
-			return nil
-		}
-
-		if !info.Mode().IsRegular() {
-			if info.Mode().IsDir() {
-				if depth == 0 {
-					return filepath.SkipDir
-				}
-				if depth > 0 {
-					depth--
-				}
-			}
-			return nil
-		}
-
-		for _, excludeRegexp := range excludeRegexps {
-			if excludeRegexp.MatchString(path) {
-				return nil
-			}
-		}
-
-		req := request{
-			path:    path,
-			modTime: info.ModTime().UnixNano(),
-		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case work <- req:
-		}
-
-		return nil
-	}
-}
-
-func appendUniq(a []string, s string) []string {
-	for _, v := range a {
-		if v == s {
-			return a
-		}
-	}
-	return append(a, s)
+func (f *stringListFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 type regexpListFlags []*regexp.Regexp
@@ -214,17 +79,52 @@ func (f *regexpListFlags) Set(value string) error {
 func main() {
 	stdlog.SetFlags(0)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "db":
+			dbMain(os.Args[2:])
+			return
+		case "query":
+			queryMain(os.Args[2:])
+			return
+		case "undo":
+			undoMain(os.Args[2:])
+			return
+		}
+	}
+
 	var (
-		threshold int
-		recurse   bool
-		noCompare bool
-		program   string
-		args      string
-		dbPath    string
-		prune     bool
-		jobs      int
-		delim     quotedString = " "
-		excludes  regexpListFlags
+		threshold    int
+		clusterName  string
+		hashName     string
+		invariance   string
+		ignoreOrient bool
+		recurse      bool
+		noCompare    bool
+		program      string
+		args         string
+		dbPath       string
+		dbBackend    string
+		libraryRoot  string
+		prune        bool
+		pruneUnder   string
+		jobs         int
+		delim        quotedString = " "
+		excludes     regexpListFlags
+		justCheckNew bool
+		references   stringListFlags
+		format       string
+		reportPath   string
+		deleteDups   bool
+		linkKind     string
+		linkSimilar  bool
+		moveTo       string
+		journalPath  string
+		keepPolicy   string
+		dryRun       bool
+		markDistinct bool
+		review       bool
+		yes          bool
 	)
 
 	defaultJobs := runtime.NumCPU()
@@ -232,6 +132,14 @@ func main() {
 	flag.IntVar(&threshold, "t", 0, "Hamming distance threshold (0..63)")
 	flag.IntVar(&threshold, "threshold", 0, "")
 
+	flag.StringVar(&clusterName, "cluster", "single", "How to group similar images: "+strings.Join(dupes.Clusters, ", "))
+
+	flag.StringVar(&hashName, "hash", "dct", "Hash algorithm: dct, ahash, dhash, whash or blockmean")
+
+	flag.StringVar(&invariance, "invariant", "", "Also find rotated (rotate) and/or mirrored (flip) copies, e.g. rotate,flip")
+
+	flag.BoolVar(&ignoreOrient, "ignore-orientation", false, "Don't turn the images upright according to their EXIF orientation")
+
 	flag.BoolVar(&recurse, "R", false, "Search for images recursively")
 	flag.BoolVar(&recurse, "recurse", false, "")
 
@@ -248,8 +156,13 @@ func main() {
 	flag.StringVar(&dbPath, "db", "", "")
 	flag.StringVar(&dbPath, "fingerprints", "", "")
 
+	flag.StringVar(&dbBackend, "db-backend", "", "Fingerprint database backend: "+strings.Join(dupes.Backends, ", ")+" (default: by the file extension)")
+
+	flag.StringVar(&libraryRoot, "library-root", "", "Store the paths under this directory relative to it in the fingerprint database")
+
 	flag.BoolVar(&prune, "P", false, "Remove fingerprint data for images that do not exist any more")
 	flag.BoolVar(&prune, "prune", false, "")
+	flag.StringVar(&pruneUnder, "prune-under", "", "Only prune the fingerprint data for the images under this directory")
 
 	flag.IntVar(&jobs, "j", defaultJobs, "Number of jobs to use for image processing")
 	flag.IntVar(&jobs, "jobs", defaultJobs, "")
@@ -257,11 +170,29 @@ func main() {
 	flag.Var(&delim, "d", "The delimiter to use when printing to stdout")
 	flag.Var(&delim, "delimiter", "")
 
+	flag.StringVar(&format, "format", "text", "Output format: text, json or ndjson")
+
+	flag.StringVar(&reportPath, "report", "", "Write an HTML report with thumbnails of the duplicates to this file")
+
+	flag.BoolVar(&deleteDups, "delete", false, "Delete all but one file of each set of dupes")
+	flag.StringVar(&linkKind, "link", "", "Replace all but one file of each set of dupes with links: hard, sym or reflink")
+	flag.BoolVar(&linkSimilar, "link-similar", false, "Allow --link for images whose fingerprints are not identical")
+	flag.StringVar(&moveTo, "move-to", "", "Move all but one file of each set of dupes to this directory")
+	flag.StringVar(&journalPath, "journal", "", "File to record the changes made by --link or --move-to in")
+	flag.StringVar(&keepPolicy, "keep", "", "Which file of each set of dupes to keep: "+strings.Join(dupes.KeepPolicies, ", "))
+	flag.BoolVar(&dryRun, "dry-run", false, "Only show what would be done")
+	flag.BoolVar(&markDistinct, "mark-distinct", false, "Mark the files on the command line as not duplicates of each other and exit")
+	flag.BoolVar(&review, "review", false, "After viewing each set of dupes, ask whether to mark its files as not duplicates")
+	flag.BoolVar(&yes, "y", false, "Don't ask for confirmation")
+	flag.BoolVar(&yes, "yes", false, "")
+
 	flag.Var(&log, "q", "Quiet mode (no warnings, if given once; no errors either, if given twice)")
 	flag.Var(&log, "quiet", "")
 
 	flag.BoolVar(&justCheckNew, "new", false, "Just check new files (those on the command line)")
 
+	flag.Var(&references, "reference", "Only report the duplicates of the images in this directory of trusted images, which are never removed")
+
 	flag.Var(&excludes, "e", "Exclude any files/directories that contain this regexp")
 	flag.Var(&excludes, "exclude", "")
 
@@ -270,33 +201,126 @@ func main() {
 
     Options:
        -t, --threshold=AMOUNT         Use AMOUNT as threshold of similarity (0..63; default 0)
+           --cluster=METHOD           How to group similar images: single (default; chains of images
+                                          each similar to the next), complete (every two images in a
+                                          set are similar) or star (images similar to a central one)
+           --hash=ALGORITHM           Hash algorithm: dct (default), ahash, dhash, whash or blockmean;
+                                          the fingerprints of every algorithm are kept apart in the
+                                          fingerprint database
+           --invariant=LIST           Also find rotated and/or mirrored copies of the images; LIST is
+                                          rotate, flip or rotate,flip
+           --ignore-orientation       Don't turn the images upright according to their EXIF
+                                          orientation before fingerprinting them
        -R, --recurse                  Search recursively for images inside subdirectories
        -n, --no-compare               Don't look for duplicates
        -p, --program=PROGRAM          Launch PROGRAM (in foreground) to view each set of dupes
            --args=ARGUMENTS           Pass additional ARGUMENTS to the program before the filenames;
                                           e.g. for feh, '-. -^ "%%u / %%l - %%wx%%h - %%n"'
-       -f, --fingerprints=FILE        Use FILE as fingerprint database
+       -f, --fingerprints=FILE        Use FILE as fingerprint database; a postgres://
+                                          URL uses a PostgreSQL database, which can be shared
+           --db-backend=BACKEND       Store the fingerprint database with BACKEND: sqlite, bolt,
+                                          a pure Go key-value store, or postgres; the default is
+                                          postgres for the postgres:// URLs, bolt for the .bolt and
+                                          .bbolt files, sqlite otherwise; findimagedupes still needs
+                                          cgo for pHash and libmagic with any of them
+           --library-root=DIR         Store the paths of the files under DIR relative to it in the
+                                          fingerprint database, so that DIR can be moved or mounted
+                                          elsewhere; it is remembered in the database, so only give
+                                          it again when DIR has moved
        -P, --prune                    Remove fingerprint data for images that do not exist any more
+                                          and refresh that of modified images
+           --prune-under=DIR          Only prune the fingerprint data for the images under DIR;
+                                          implies --prune
        -j, --jobs                     Number of jobs to use for image processing (default %d)
        -d, --delimiter                The delimiter to use when printing to stdout (default SPACE);
                                           use \000 for NULL byte or \x09 for TAB.
+           --format=FORMAT            Print the duplicates as text (default), json or ndjson;
+                                          the JSON output contains the fingerprints, distances,
+                                          sizes and modification times of the files, and marks
+                                          byte-identical copies as exact
+           --report=FILE              Write an HTML page with thumbnails of the duplicates to FILE
+           --delete                   Delete all but one file of each set of dupes; the files to be
+                                          deleted are listed and confirmation is asked first
+           --link=KIND                Replace all but one file of each set of dupes with hard links,
+                                          symbolic links or reflinks (KIND is hard, sym or reflink)
+                                          to the kept file; only sets of files with identical
+                                          fingerprints are linked
+           --link-similar             Link similar files too, not only those with identical fingerprints
+           --move-to=DIR              Move all but one file of each set of dupes to DIR, keeping
+                                          their paths relative to the directories they were found in;
+                                          use 'findimagedupes undo JOURNAL' to move them back
+           --journal=FILE             Record the replaced or moved files in FILE (default
+                                          findimagedupes-DATE-TIME.journal in the current directory
+                                          for --link, in DIR for --move-to)
+           --keep=POLICY              Which file of each set to keep: largest, smallest,
+                                          highest-resolution, oldest, newest, shortest-path or
+                                          first-root (the first directory on the command line)
+           --dry-run                  Only list what --delete, --link or --move-to would do
+           --mark-distinct            Mark the files on the command line as not duplicates of each
+                                          other in the fingerprint database, and exit; they are
+                                          never reported together again
+           --review                   After viewing each set of dupes with --program, ask whether
+                                          to mark its files as not duplicates of each other
+       -y, --yes                      Don't ask for confirmation
        -q, --quiet                    If this option is given, warnings are not displayed; if it is
                                           given twice, non-fatal errors are not displayed either
            --new                      Only look for duplicates of files specified on the command line;
                                           matches are also sought in the fingerprint database, but
                                           the new fingerprints aren't added to it.
+           --reference=DIR            Also scan DIR, a directory of trusted images, but only report
+                                          the sets of dupes with both files from DIR and other files;
+                                          --delete, --link and --move-to never touch the files in DIR.
+                                          Can be repeated
        -e, --exclude                  Exclude any files/directories that contain this regexp
 
        -h, --help                     Show this help
 
+    Commands:
+       findimagedupes db COMMAND DB   Maintain the fingerprint database DB; run
+                                          'findimagedupes db' for the list of commands
+       findimagedupes query IMAGE     Print the fingerprint database entries nearest to IMAGE;
+                                          run 'findimagedupes query' for the options
+       findimagedupes undo JOURNAL    Move the files moved by --move-to back
+
 `, defaultJobs)
 	}
 	flag.Parse()
 
+	if pruneUnder != "" {
+		prune = true
+		abs, err := filepath.Abs(pruneUnder)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pruneUnder = abs
+	}
+
 	if prune && dbPath == "" {
 		log.Fatal("--prune used without -f")
 	}
 
+	if dbBackend == "" && dbPath != "" {
+		dbBackend = dupes.BackendOf(dbPath)
+	}
+
+	switch dbBackend {
+	case "", "sqlite":
+	case "bolt", "postgres":
+		if libraryRoot != "" {
+			log.Fatalf("--library-root is not supported by the %s backend", dbBackend)
+		}
+	default:
+		log.Fatalf("unknown --db-backend: %s", dbBackend)
+	}
+
+	if markDistinct && dbPath == "" {
+		log.Fatal("--mark-distinct used without -f")
+	}
+
+	if review && (program == "" || dbPath == "") {
+		log.Fatal("--review used without --program and -f")
+	}
+
 	if args != "" && program == "" {
 		log.Fatal("--args used without --program")
 	}
@@ -305,6 +329,75 @@ func main() {
 		log.Fatal("--no-compare used with --program")
 	}
 
+	cluster, err := dupes.ParseCluster(clusterName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hasher, err := dupes.HasherByName(hashName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transforms, err := dupes.ParseInvariance(invariance)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch format {
+	case "text", "json", "ndjson":
+	default:
+		log.Fatalf("unknown --format: %s", format)
+	}
+
+	if format != "text" && program != "" {
+		log.Fatal("--format used with --program")
+	}
+
+	if noCompare && reportPath != "" {
+		log.Fatal("--no-compare used with --report")
+	}
+
+	switch linkKind {
+	case "", "hard", "sym", "reflink":
+	default:
+		log.Fatalf("unknown --link: %s", linkKind)
+	}
+
+	actions := 0
+	for _, set := range []bool{deleteDups, linkKind != "", moveTo != ""} {
+		if set {
+			actions++
+		}
+	}
+
+	var keep dupes.KeepPolicy
+	if actions > 0 {
+		if actions > 1 {
+			log.Fatal("only one of --delete, --link and --move-to can be used")
+		}
+		if keepPolicy == "" {
+			log.Fatal("--delete, --link or --move-to used without --keep")
+		}
+		if noCompare || program != "" || format != "text" {
+			log.Fatal("--delete, --link and --move-to cannot be used with --no-compare, --program or --format")
+		}
+		keep, err = dupes.ParseKeepPolicy(keepPolicy, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if keepPolicy != "" || dryRun {
+		log.Fatal("--keep and --dry-run are useless without --delete, --link or --move-to")
+	}
+
+	if linkKind == "" && linkSimilar {
+		log.Fatal("--link-similar is useless without --link")
+	}
+
+	if linkKind == "" && moveTo == "" && journalPath != "" {
+		log.Fatal("--journal is useless without --link or --move-to")
+	}
+
 	if noCompare && dbPath == "" {
 		log.Fatal("--no-compare is useless without -f")
 	}
@@ -326,16 +419,32 @@ func main() {
 		}
 	}()
 
-	var db *DB
+	var db dupes.FingerprintStore
 	if dbPath != "" {
 		var err error
-		db, err = OpenDatabase(dbPath)
+		db, err = dupes.OpenStore(dbPath, dbBackend)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
+		}
+
+		if libraryRoot != "" {
+			if err := db.(*dupes.DB).SetRoot(ctx, libraryRoot); err != nil {
+				db.Close()
+				log.Fatal(err)
+			}
 		}
 
 		if prune {
-			if err := db.Prune(ctx); err != nil {
+			spinner := NewSpinner()
+			st, err := db.Prune(ctx, dupes.PruneOptions{
+				Under:    pruneUnder,
+				Jobs:     jobs,
+				Log:      log,
+				Progress: spinner.Spin,
+			})
+			spinner.Stop()
+			fmt.Fprintf(os.Stderr, "Pruned: %d entries checked, %d removed, %d refreshed.\n", st.Checked, st.Removed, st.Refreshed)
+			if err != nil {
 				db.Close()
 				if err == context.Canceled {
 					os.Exit(1) //nolint:gocritic
@@ -345,6 +454,22 @@ func main() {
 		}
 	}
 
+	if markDistinct {
+		if flag.NArg() < 2 {
+			db.Close()
+			log.Fatal("--mark-distinct needs two or more files")
+		}
+		n, err := markPairsDistinct(ctx, db, flag.Args())
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "%d pairs marked as not duplicates.\n", n)
+		return
+	}
+
 	if flag.NArg() == 0 {
 		if prune {
 			os.Exit(0)
@@ -362,150 +487,132 @@ func main() {
 	if recurse {
 		maxDepth = -1
 	}
-	m := make(map[uint64][]string)
-
-	results := make(chan result)
 
-	workC := make(chan request)
-	workDone := make(chan chan struct{}, jobs)
-	for i := 0; i < jobs; i++ {
-		done := make(chan struct{})
-		go worker(ctx, db, workC, results, done)
-		workDone <- done
+	finder := dupes.NewFinder(dupes.Options{
+		Threshold:         threshold,
+		Cluster:           cluster,
+		Hasher:            hasher,
+		Transforms:        transforms,
+		IgnoreOrientation: ignoreOrient,
+		Depth:             maxDepth,
+		Excludes:          excludes,
+		Jobs:              jobs,
+		DB:                db,
+		NewOnly:           justCheckNew,
+		References:        references,
+		Progress:          spinner.Spin,
+		Log:               log,
+	})
+
+	var groups []dupes.Group
+	if noCompare {
+		_, err = finder.Scan(ctx, flag.Args())
+	} else {
+		groups, err = finder.Find(ctx, flag.Args())
 	}
-	close(workDone)
-
-	resultDone := make(chan struct{})
-	go resultWorker(m, results, resultDone)
 
-	for _, d := range flag.Args() {
-		walkFn := process(ctx, maxDepth, excludes, spinner, workC)
-		if err := filepath.Walk(d, walkFn); err != nil {
-			log.Error(err)
+	if db != nil && err == nil && !noCompare {
+		if distinct, err := loadDistinct(ctx, db); err != nil {
+			log.Errorf("ERROR: %v", err)
+		} else {
+			groups = dupes.SplitDistinct(groups, distinct)
+			if len(references) > 0 {
+				groups = dupes.ReferencedGroups(groups)
+			}
 		}
 	}
 
-	close(workC)
-	for done := range workDone {
-		<-done
+	if db != nil {
+		if err := db.Close(); err != nil {
+			log.Errorf("Error closing DB: %v", err)
+		}
 	}
-	close(results)
-	<-resultDone
 
 	// Exit immediately if the program was interrupted.
-	select {
-	case <-ctx.Done():
-		if db != nil {
-			err := db.Close()
-			if err != nil {
-				log.Errorf("Error closing DB: %v", err)
-			}
-		}
+	if err != nil {
 		os.Exit(1)
-	default:
 	}
 
 	signal.Stop(sig) // Stop handling interrupts gracefully.
 
 	spinner.Stop()
 
-	if noCompare {
-		os.Exit(0)
+	if reportPath != "" {
+		if err := writeReport(reportPath, groups, jobs); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Produce repeatable output.
-	hashes := make([]uint64, 0, len(m))
-	for h, files := range m {
-		hashes = append(hashes, h)
-		sort.Strings(files)
+	if deleteDups {
+		deleteDupes(makePlans(groups, keep), dryRun, yes)
+		return
 	}
-	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
 
-	if db != nil {
-		if justCheckNew {
-			// Find duplicates for the files on the command line in the fingerprint database.
-			entries, err := db.GetAll(ctx)
-			if err != nil {
-				log.Errorf("Error: cannot get all fingerprints: %v", err)
-			} else {
-				for _, e := range entries {
-					h0 := e.fp
-					if _, ok := m[h0]; ok {
-						m[h0] = appendUniq(m[h0], e.path)
-					} else {
-						for _, h := range hashes {
-							d := phash.HammingDistance(h0, h)
-							if d <= threshold {
-								m[h] = append(m[h], e.path)
-								break
-							}
-						}
-					}
-				}
+	if linkKind != "" || moveTo != "" {
+		plans := makePlans(groups, keep)
+		if journalPath == "" {
+			dir := "."
+			if moveTo != "" {
+				dir = moveTo
 			}
+			journalPath = defaultJournalPath(dir)
 		}
-
-		err := db.Close()
-		if err != nil {
-			log.Errorf("Error closing DB: %v", err)
+		j := newJournal(journalPath)
+		if !dryRun {
+			if err := j.open(); err != nil {
+				log.Fatal(err)
+			}
 		}
-	}
 
-	// Find similar hashes.
-	if threshold > 0 {
-		// Use union-find to group hashes.
-		parent := make([]int, len(hashes))
-		for i := range parent {
-			parent[i] = i
-		}
-		var find func(int) int
-		find = func(i int) int {
-			if i != parent[i] {
-				parent[i] = find(parent[i])
+		if linkKind != "" {
+			if !linkSimilar {
+				plans = exactOnly(plans)
 			}
-			return parent[i]
+			linkDupes(plans, linkKind, j, dryRun, yes)
+		} else {
+			if !dryRun {
+				if err := os.MkdirAll(moveTo, 0o755); err != nil {
+					log.Fatal(err)
+				}
+			}
+			moveDupes(plans, moveTo, j, dryRun, yes)
 		}
 
-		for i := 0; i < len(hashes)-1; i++ {
-			for j := i + 1; j < len(hashes); j++ {
-				h1 := hashes[i]
-				h2 := hashes[j]
-
-				d := phash.HammingDistance(h1, h2)
-				if d > threshold {
-					continue
-				}
+		if err := j.Close(); err != nil {
+			log.Errorf("ERROR: %v", err)
+		} else if j.n > 0 {
+			fmt.Fprintf(os.Stderr, "Journal written to %s\n", journalPath)
+		}
+		return
+	}
 
-				p1, p2 := find(i), find(j)
-				if p1 == p2 {
-					continue
-				}
+	// Print or view duplicates.
+	if program == "" {
+		if err := writeGroups(os.Stdout, format, groups, string(delim)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-				parent[p2] = p1
-				h1p, h2p := hashes[p1], hashes[p2]
-				m[h1p] = append(m[h1p], m[h2p]...)
-				delete(m, h2p)
-			}
+	if review {
+		if db, err = dupes.OpenStore(dbPath, dbBackend); err != nil {
+			log.Fatal(err)
 		}
+		defer db.Close()
 	}
 
-	// Print or view duplicates.
-	for _, h := range hashes {
-		files := m[h]
-		if len(files) < 2 {
-			continue
+	for _, g := range groups {
+		args := append(programArgs, g.Paths()...) //nolint:gocritic
+		cmd := exec.Command(program, args...)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			log.Errorf("ERROR: %s %s: %v", program, strings.Join(args, " "), err)
 		}
 
-		sort.Strings(files)
-		if program == "" {
-			fmt.Println(strings.Join(files, string(delim))) //nolint:forbidigo
-		} else {
-			args := append(programArgs, files...) //nolint:gocritic
-			cmd := exec.Command(program, args...)
-			cmd.Stderr = os.Stderr
-			err := cmd.Run()
-			if err != nil {
-				log.Errorf("ERROR: %s %s: %v", program, strings.Join(args, " "), err)
+		if review && confirm("Mark these files as not duplicates of each other?") {
+			if _, err := markPairsDistinct(context.Background(), db, g.Paths()); err != nil {
+				log.Errorf("ERROR: %v", err)
 			}
 		}
 	}
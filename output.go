@@ -0,0 +1,96 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gitlab.com/opennota/findimagedupes/dupes"
+)
+
+type jsonFile struct {
+	Path        string    `json:"path"`
+	Fingerprint string    `json:"fingerprint"`
+	Distance    int       `json:"distance"`
+	Transform   string    `json:"transform,omitempty"`
+	Exact       bool      `json:"exact,omitempty"`
+	Reference   bool      `json:"reference,omitempty"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+}
+
+type jsonGroup struct {
+	Fingerprint string     `json:"fingerprint"`
+	MaxDistance int        `json:"max_distance"`
+	Files       []jsonFile `json:"files"`
+}
+
+func hexFP(fp uint64) string {
+	return fmt.Sprintf("%016x", fp)
+}
+
+func toJSONGroup(g dupes.Group) jsonGroup {
+	jg := jsonGroup{
+		Fingerprint: hexFP(g.FP),
+		MaxDistance: g.MaxDistance(),
+		Files:       make([]jsonFile, 0, len(g.Files)),
+	}
+	for _, f := range g.Files {
+		jf := jsonFile{
+			Path:        f.Path,
+			Fingerprint: hexFP(f.FP),
+			Distance:    g.Distance(f),
+			Exact:       g.Exact(f),
+			Reference:   f.Reference,
+			Size:        f.Size,
+			ModTime:     f.ModTime,
+		}
+		if t := g.Transform(f); t != dupes.Identity {
+			jf.Transform = t.String()
+		}
+		jg.Files = append(jg.Files, jf)
+	}
+	return jg
+}
+
+func writeGroups(w io.Writer, format string, groups []dupes.Group, delim string) error {
+	switch format {
+	case "json":
+		jgs := make([]jsonGroup, 0, len(groups))
+		for _, g := range groups {
+			jgs = append(jgs, toJSONGroup(g))
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jgs)
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		for _, g := range groups {
+			if err := enc.Encode(toJSONGroup(g)); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, g := range groups {
+			if _, err := fmt.Fprintln(w, strings.Join(g.Paths(), delim)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/opennota/findimagedupes/dupes"
+)
+
+type jsonMatch struct {
+	Path        string `json:"path"`
+	Fingerprint string `json:"fingerprint"`
+	Distance    int    `json:"distance"`
+}
+
+// queryMain implements the query command, which looks for the entries of the
+// fingerprint database similar to an image.
+func queryMain(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	var (
+		dbPath       string
+		dbBackend    string
+		hashName     string
+		k            int
+		threshold    int
+		ignoreOrient bool
+		format       string
+	)
+	fs.StringVar(&dbPath, "f", "", "File to use as a fingerprint database")
+	fs.StringVar(&dbPath, "fp", "", "")
+	fs.StringVar(&dbPath, "db", "", "")
+	fs.StringVar(&dbPath, "fingerprints", "", "")
+	fs.StringVar(&dbBackend, "db-backend", "", "Fingerprint database backend")
+	fs.StringVar(&hashName, "hash", "dct", "Hash algorithm")
+	fs.IntVar(&k, "k", 10, "Number of matches")
+	fs.IntVar(&threshold, "t", 63, "Hamming distance threshold (0..63)")
+	fs.IntVar(&threshold, "threshold", 63, "")
+	fs.BoolVar(&ignoreOrient, "ignore-orientation", false, "Don't turn the image upright according to its EXIF orientation")
+	fs.StringVar(&format, "format", "text", "Output format: text or json")
+	fs.Var(&log, "q", "Quiet mode")
+	fs.Var(&log, "quiet", "")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: findimagedupes query [options] IMAGE
+
+    Print the entries of the fingerprint database nearest to IMAGE, or to
+    the image read from the standard input if IMAGE is -, with their
+    distances, nearest first. No directories are scanned.
+
+    Options:
+       -f, --fingerprints=FILE        Use FILE as fingerprint database
+           --db-backend=BACKEND       The backend of the database: sqlite, bolt or postgres
+           --hash=ALGORITHM           The hash algorithm the database was built with (default dct)
+       -k N                           Print at most N entries (default 10); 0 prints them all
+       -t, --threshold=T              Only print the entries within the Hamming distance T
+                                          (default 63)
+           --ignore-orientation       Don't turn IMAGE upright according to its EXIF orientation
+           --format=FORMAT            Print the entries as text (default) or json
+       -q, --quiet                    Don't display warnings
+
+`)
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 || dbPath == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if threshold < 0 || threshold > 63 {
+		log.Fatal("--threshold must be between 0 and 63")
+	}
+
+	switch format {
+	case "text", "json":
+	default:
+		log.Fatalf("unknown --format: %s", format)
+	}
+
+	hasher, err := dupes.HasherByName(hashName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := fs.Arg(0)
+	var tmp string
+	if path == "-" {
+		if tmp, err = readStdin(); err != nil {
+			log.Fatal(err)
+		}
+		path = tmp
+	}
+
+	err = query(path, k, format, dbPath, dbBackend, dupes.Options{
+		Threshold:         threshold,
+		Hasher:            hasher,
+		IgnoreOrientation: ignoreOrient,
+		Log:               log,
+	})
+	// log.Fatal skips the deferred calls.
+	if tmp != "" {
+		os.Remove(tmp)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// query prints the k entries of the fingerprint database nearest to the
+// image at path in the given format.
+func query(path string, k int, format, dbPath, dbBackend string, opts dupes.Options) error {
+	db, err := dupes.OpenStore(dbPath, dbBackend)
+	if err != nil {
+		return err
+	}
+	opts.DB = db
+	fp, matches, err := dupes.NewFinder(opts).Query(context.Background(), path, k)
+	db.Close()
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		jms := make([]jsonMatch, 0, len(matches))
+		for _, m := range matches {
+			jms = append(jms, jsonMatch{Path: m.Path, Fingerprint: hexFP(m.FP), Distance: m.Distance})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Fingerprint string      `json:"fingerprint"`
+			Matches     []jsonMatch `json:"matches"`
+		}{hexFP(fp), jms})
+	}
+
+	for _, m := range matches {
+		fmt.Printf("%d %s\n", m.Distance, m.Path) //nolint:forbidigo
+	}
+	return nil
+}
+
+// readStdin copies the standard input to a temporary file and returns its
+// path.
+func readStdin() (string, error) {
+	f, err := ioutil.TempFile("", "findimagedupes-query-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,212 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"image"
+	_ "image/gif" // Register decoders.
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"runtime"
+	"sync"
+
+	"gitlab.com/opennota/findimagedupes/dupes"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const thumbnailSize = 200
+
+type reportFile struct {
+	dupes.File
+	Distance  int
+	Transform string
+	Exact     bool
+	Width     int
+	Height    int
+	Thumbnail template.URL
+}
+
+type reportGroup struct {
+	Fingerprint string
+	MaxDistance int
+	Files       []reportFile
+}
+
+// thumbnail decodes the image at path and returns its dimensions and a
+// downscaled JPEG copy of it as a data URI.
+func thumbnail(path string) (int, int, template.URL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(bufio.NewReader(f))
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if tw > thumbnailSize || th > thumbnailSize {
+		if tw > th {
+			tw, th = thumbnailSize, h*thumbnailSize/w
+		} else {
+			tw, th = w*thumbnailSize/h, thumbnailSize
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return 0, 0, "", err
+	}
+
+	uri := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return w, h, template.URL(uri), nil //nolint:gosec
+}
+
+// writeReport writes a self-contained HTML page with the thumbnails of the
+// duplicates to path, making them with jobs goroutines; as many as there are
+// CPUs if jobs is not positive.
+func writeReport(path string, groups []dupes.Group, jobs int) error {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	rgs := make([]reportGroup, len(groups))
+	type job struct {
+		rf   *reportFile
+		path string
+	}
+	work := make(chan job)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				var err error
+				j.rf.Width, j.rf.Height, j.rf.Thumbnail, err = thumbnail(j.path)
+				if err != nil {
+					log.Warnf("WARNING: %s: %v", j.path, err)
+				}
+			}
+		}()
+	}
+
+	for i, g := range groups {
+		rg := &rgs[i]
+		rg.Fingerprint = hexFP(g.FP)
+		rg.MaxDistance = g.MaxDistance()
+		rg.Files = make([]reportFile, len(g.Files))
+		for j, f := range g.Files {
+			rg.Files[j] = reportFile{File: f, Distance: g.Distance(f), Exact: g.Exact(f)}
+			if t := g.Transform(f); t != dupes.Identity {
+				rg.Files[j].Transform = t.String()
+			}
+			work <- job{&rg.Files[j], f.Path}
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := reportTemplate.Execute(w, rgs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>findimagedupes</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.group { border-top: 1px solid #ccc; padding: 0.5em 0; }
+.file { display: inline-block; vertical-align: top; width: 220px; margin: 0.5em; font-size: small; word-wrap: break-word; }
+.thumb { width: 200px; height: 200px; display: flex; align-items: center; justify-content: center; background: #eee; }
+.file.marked .thumb { outline: 3px solid #c00; }
+#toolbar { position: sticky; top: 0; background: #fff; padding: 0.5em 0; }
+</style>
+</head>
+<body>
+<div id="toolbar">
+{{len .}} groups.
+<button onclick="exportList()">Export deletion list</button>
+<span id="count">0</span> files marked.
+</div>
+{{range $i, $g := .}}
+<div class="group">
+<h3>Group {{$i}}: fingerprint {{$g.Fingerprint}}, max distance {{$g.MaxDistance}}</h3>
+{{range $g.Files}}
+<label class="file">
+<div class="thumb">{{if .Thumbnail}}<img src="{{.Thumbnail}}">{{else}}no preview{{end}}</div>
+<input type="checkbox" data-path="{{.Path}}" onchange="mark(this)">
+{{.Path}}<br>
+{{if .Width}}{{.Width}}x{{.Height}}, {{end}}{{.Size}} bytes, distance {{.Distance}}{{with .Transform}} ({{.}}){{end}}{{if .Exact}}, <b>exact copy</b>{{end}}{{if .Reference}}, <b>reference</b>{{end}}
+</label>
+{{end}}
+</div>
+{{end}}
+<script>
+function mark(cb) {
+	cb.parentNode.classList.toggle("marked", cb.checked);
+	document.getElementById("count").textContent =
+		document.querySelectorAll("input[data-path]:checked").length;
+}
+function exportList() {
+	var paths = [];
+	document.querySelectorAll("input[data-path]:checked").forEach(function(cb) {
+		paths.push(cb.dataset.path);
+	});
+	var a = document.createElement("a");
+	a.href = URL.createObjectURL(new Blob([paths.join("\n") + "\n"], {type: "text/plain"}));
+	a.download = "delete.txt";
+	a.click();
+}
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,96 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// undoMain implements the undo command, which moves the files moved by
+// --move-to back to where they were.
+func undoMain(args []string) {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "Only show what would be done")
+	fs.Var(&log, "q", "Quiet mode")
+	fs.Var(&log, "quiet", "")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: findimagedupes undo [options] JOURNAL
+
+    Move the files moved by --move-to back to their original locations.
+
+    Options:
+           --dry-run                  Only show what would be done
+       -q, --quiet                    Don't display warnings
+
+`)
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	records, err := readJournal(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	n := 0
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if r.Op != "move" {
+			log.Warnf("WARNING: %s: cannot undo %s", r.Path, r.Op)
+			continue
+		}
+
+		fmt.Printf("restore %s\n", r.Path) //nolint:forbidigo
+		if dryRun {
+			n++
+			continue
+		}
+
+		if _, err := os.Lstat(r.Path); err == nil {
+			log.Errorf("ERROR: %s already exists", r.Path)
+			failed = true
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(r.Path), 0o755); err != nil {
+			log.Errorf("ERROR: %v", err)
+			failed = true
+			continue
+		}
+		if err := moveFile(r.Target, r.Path); err != nil {
+			log.Errorf("ERROR: %v", err)
+			failed = true
+			continue
+		}
+		n++
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: %d files would be restored.\n", n) //nolint:forbidigo
+		return
+	}
+	fmt.Printf("%d files restored.\n", n) //nolint:forbidigo
+
+	if failed {
+		os.Exit(1)
+	}
+}